@@ -0,0 +1,38 @@
+// Package auth 负责请求方身份：凭据校验与真实客户端 IP。
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// Credentials 从查询参数中取出 user/pass
+func Credentials(r *http.Request) (user, pass string) {
+	q := r.URL.Query()
+	return q.Get("user"), q.Get("pass")
+}
+
+// Admin 校验管理凭据：Authorization: Bearer <token>、X-Admin-Token 头或 admin_token 参数
+func Admin(cfg *config.Config, r *http.Request) bool {
+	want := cfg.Admin.Token
+	if want == "" {
+		return false
+	}
+	got := r.Header.Get("X-Admin-Token")
+	if v, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		got = v
+	}
+	if got == "" {
+		got = r.URL.Query().Get("admin_token")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// Check 校验用户名与密码
+func Check(cfg *config.Config, user, pass string) bool {
+	u, ok := cfg.Users[user]
+	return ok && !u.Disabled && u.Password == pass
+}
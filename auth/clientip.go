@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+func isTrusted(trusted []netip.Prefix, a netip.Addr) bool {
+	a = a.Unmap()
+	for _, p := range trusted {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP 返回真实客户端 IP：仅当直连方是受信代理时才解析 Forwarded / X-Forwarded-For / X-Real-IP，
+// 链路从右向左跳过受信代理，取第一个非受信地址
+func ClientIP(r *http.Request, trusted []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil || !isTrusted(trusted, remote) {
+		return host
+	}
+
+	chain := forwardedFor(r.Header)
+	if len(chain) == 0 {
+		chain = splitList(r.Header.Values("X-Forwarded-For"))
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		a, err := parseHostAddr(chain[i])
+		if err != nil {
+			// 无法解析（如 "unknown" / 混淆标识），其左侧内容不可信
+			break
+		}
+		if !isTrusted(trusted, a) || i == 0 {
+			return a.String()
+		}
+	}
+	if xr := strings.TrimSpace(r.Header.Get("X-Real-IP")); xr != "" {
+		if a, err := parseHostAddr(xr); err == nil {
+			return a.String()
+		}
+	}
+	return host
+}
+
+// RFC 7239 Forwarded 头中的 for= 列表
+func forwardedFor(h http.Header) []string {
+	var out []string
+	for _, elem := range splitList(h.Values("Forwarded")) {
+		for _, pair := range strings.Split(elem, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(k, "for") {
+				out = append(out, strings.Trim(v, `"`))
+			}
+		}
+	}
+	return out
+}
+
+func splitList(vals []string) []string {
+	var out []string
+	for _, v := range vals {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				out = append(out, f)
+			}
+		}
+	}
+	return out
+}
+
+// 兼容 "1.2.3.4"、"1.2.3.4:5678"、"[2001:db8::1]:443"、"2001:db8::1"
+func parseHostAddr(s string) (netip.Addr, error) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	a, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	return a.Unmap(), err
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stream-proxy bench：N 个模拟客户端压测目标代理，可选内置假源站
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	target := fs.String("url", "", "压测地址，如 http://127.0.0.1:8000/stream?user=test&pass=123456&path=live.ts")
+	clients := fs.Int("c", 10, "并发客户端数")
+	duration := fs.Duration("d", 30*time.Second, "压测时长")
+	ramp := fs.Duration("ramp", 0, "客户端在该时间内均匀启动")
+	origin := fs.String("origin", "", "启动内置假源站的监听地址，如 127.0.0.1:8080（代理的 stream_host 需指向它）")
+	originKbps := fs.Int("origin-kbps", 4000, "假源站每路输出码率（kbit/s）")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" {
+		fmt.Fprintln(os.Stderr, "bench: 缺少 -url")
+		fs.Usage()
+		return 2
+	}
+
+	if *origin != "" {
+		ln, err := net.Listen("tcp", *origin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bench: 假源站监听失败: %v\n", err)
+			return 1
+		}
+		go http.Serve(ln, fakeOrigin(*originKbps))
+		log.Printf("[Bench] 假源站 http://%s/ (%d kbit/s)", ln.Addr(), *originKbps)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	st := &benchStats{errs: map[string]int{}}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *clients; i++ {
+		delay := time.Duration(0)
+		if *clients > 1 {
+			delay = *ramp * time.Duration(i) / time.Duration(*clients-1)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			benchClient(ctx, *target, st)
+		}()
+	}
+	wg.Wait()
+	st.report(os.Stdout, *clients, time.Since(start))
+	return 0
+}
+
+type benchStats struct {
+	bytes atomic.Int64
+
+	mu       sync.Mutex
+	requests int
+	errs     map[string]int
+	ttfb     []time.Duration
+}
+
+func (s *benchStats) addErr(kind string) {
+	s.mu.Lock()
+	s.errs[kind]++
+	s.mu.Unlock()
+}
+
+// 单个客户端：持续拉流，断开后重连，直到压测结束
+func benchClient(ctx context.Context, target string, st *benchStats) {
+	buf := make([]byte, 64<<10)
+	for ctx.Err() == nil {
+		st.mu.Lock()
+		st.requests++
+		st.mu.Unlock()
+
+		t0 := time.Now()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			st.addErr("bad_request")
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				st.addErr("connect")
+				time.Sleep(200 * time.Millisecond)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			st.addErr(fmt.Sprintf("http_%d", resp.StatusCode))
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+		first := true
+		for {
+			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				if first {
+					first = false
+					st.mu.Lock()
+					st.ttfb = append(st.ttfb, time.Since(t0))
+					st.mu.Unlock()
+				}
+				st.bytes.Add(int64(n))
+			}
+			if err != nil {
+				if ctx.Err() == nil && !errors.Is(err, io.EOF) {
+					st.addErr("read")
+				}
+				break
+			}
+		}
+		resp.Body.Close()
+	}
+}
+
+func (s *benchStats) report(w io.Writer, clients int, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := s.bytes.Load()
+	secs := elapsed.Seconds()
+	fmt.Fprintf(w, "客户端: %d  时长: %s  请求: %d\n", clients, elapsed.Round(time.Millisecond), s.requests)
+	fmt.Fprintf(w, "吞吐: %.2f MB  总计 %.2f Mbit/s  每客户端 %.2f Mbit/s\n",
+		float64(total)/(1<<20), float64(total)*8/secs/1e6, float64(total)*8/secs/1e6/float64(clients))
+
+	nerr := 0
+	kinds := make([]string, 0, len(s.errs))
+	for k, n := range s.errs {
+		nerr += n
+		kinds = append(kinds, k)
+	}
+	slices.Sort(kinds)
+	rate := 0.0
+	if s.requests > 0 {
+		rate = float64(nerr) / float64(s.requests) * 100
+	}
+	fmt.Fprintf(w, "错误: %d (%.2f%%)\n", nerr, rate)
+	for _, k := range kinds {
+		fmt.Fprintf(w, "  %-12s %d\n", k, s.errs[k])
+	}
+
+	if len(s.ttfb) == 0 {
+		fmt.Fprintln(w, "首字节延迟: 无样本")
+		return
+	}
+	slices.Sort(s.ttfb)
+	fmt.Fprintf(w, "首字节延迟: p50=%s p90=%s p99=%s max=%s\n",
+		percentile(s.ttfb, 50), percentile(s.ttfb, 90), percentile(s.ttfb, 99), s.ttfb[len(s.ttfb)-1])
+}
+
+// sorted 需已升序
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	return sorted[max(0, min(i, len(sorted)-1))].Round(time.Microsecond)
+}
+
+// 假源站：任意路径均按固定码率输出 TS 包（每 100 包一个关键帧标记）
+func fakeOrigin(kbps int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const pkts, pktSize = 100, 188
+		chunk := make([]byte, pktSize*pkts)
+		for i := 0; i < pkts; i++ {
+			p := chunk[i*pktSize:]
+			p[0], p[1], p[2], p[3] = 0x47, 0x01, 0x00, 0x10
+			if i == 0 {
+				p[3], p[4], p[5] = 0x30, 1, 0x40 // adaptation field + random_access_indicator
+			}
+		}
+		interval := time.Duration(float64(len(chunk)*8) / float64(max(kbps, 1)*1000) * float64(time.Second))
+		w.Header().Set("Content-Type", "video/mp2t")
+		rc := http.NewResponseController(w)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			_ = rc.Flush()
+			select {
+			case <-tick.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
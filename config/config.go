@@ -0,0 +1,852 @@
+// Package config 定义 stream-proxy 的配置结构、加载与热加载。
+package config
+
+import (
+	"cmp"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ListenCfg struct {
+	Host  string   `json:"host"`
+	Hosts []string `json:"hosts,omitempty"` // 同时监听多个地址，如 ["0.0.0.0", "::"]；设置后忽略 host
+	Port  int      `json:"port"`
+	TCP   TCPCfg   `json:"tcp"`
+	TLS   TLSCfg   `json:"tls"`
+}
+
+// TLS 终止；cert 与 key 均为 PEM 文件路径，文件更新或 SIGHUP 时热加载
+type TLSCfg struct {
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+// Addrs 返回所有监听地址
+func (l ListenCfg) Addrs() []string {
+	hosts := l.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{l.Host}
+	}
+	addrs := make([]string, len(hosts))
+	for i, h := range hosts {
+		addrs[i] = net.JoinHostPort(h, strconv.Itoa(l.Port))
+	}
+	return addrs
+}
+
+func (t TLSCfg) Enabled() bool { return t.Cert != "" && t.Key != "" }
+
+// 监听 socket 调优；零值表示沿用系统/Go 默认
+type TCPCfg struct {
+	NoDelay              *bool `json:"no_delay,omitempty"`                // 默认 true（Go 默认）
+	SendBuffer           int   `json:"send_buffer,omitempty"`             // SO_SNDBUF，字节
+	RecvBuffer           int   `json:"recv_buffer,omitempty"`             // SO_RCVBUF，字节
+	KeepAliveIdleSec     int   `json:"keep_alive_idle_sec,omitempty"`     // 默认 15，<0 关闭 keep-alive
+	KeepAliveIntervalSec int   `json:"keep_alive_interval_sec,omitempty"` // 探测间隔，默认 15
+	KeepAliveCount       int   `json:"keep_alive_count,omitempty"`        // 探测次数，默认 9
+	ReusePort            bool  `json:"reuse_port,omitempty"`              // SO_REUSEPORT
+}
+
+type Config struct {
+	Version           int                      `json:"version"` // schema 版本，见 CurrentVersion
+	Listen            ListenCfg                `json:"listen"`
+	StreamHost        string                   `json:"stream_host"`
+	StreamHostHeader  string                   `json:"stream_host_header,omitempty"` // 覆盖发往上游的 Host 头（与连接地址不同时，如共享 CDN）
+	StreamSNI         string                   `json:"stream_sni,omitempty"`         // 覆盖 TLS SNI，同时用于证书校验
+	Users             map[string]UserCfg       `json:"users"`
+	Groups            map[string]GroupCfg      `json:"groups,omitempty"`
+	Channels          map[string]ChannelCfg    `json:"channels,omitempty"`
+	Backpressure      BackpressureCfg          `json:"backpressure"`
+	Flush             FlushCfg                 `json:"flush"`
+	Admission         AdmissionCfg             `json:"admission"`
+	Idle              IdleCfg                  `json:"idle"`
+	RequestHeaders    RequestHeadersCfg        `json:"request_headers"`
+	ResponseHeaders   ResponseHeadersCfg       `json:"response_headers"`
+	Query             QueryCfg                 `json:"query"`
+	TrustedProxies    []string                 `json:"trusted_proxies,omitempty"`
+	Admin             AdminCfg                 `json:"admin"`
+	Cache             CacheCfg                 `json:"cache"`
+	Health            HealthCfg                `json:"health"`
+	Routes            map[string][]string      `json:"routes,omitempty"` // 路由 -> 中间件链，如 {"/stream": ["gzip","logging","metrics","auth","ratelimit","rewrite"]}
+	RateLimit         RateLimitCfg             `json:"rate_limit"`
+	Rewrites          []RewriteRule            `json:"rewrites,omitempty"`
+	Plugins           []PluginCfg              `json:"plugins,omitempty"`
+	Scripts           ScriptsCfg               `json:"scripts,omitempty"`
+	Tenants           map[string]TenantCfg     `json:"tenants,omitempty"`
+	History           HistoryCfg               `json:"history"`
+	Resume            ResumeCfg                `json:"resume"`
+	Pacing            PacingCfg                `json:"pacing"`
+	ABRProfiles       map[string]ABRProfileCfg `json:"abr_profiles,omitempty"`
+	ABRProfile        string                   `json:"abr_profile,omitempty"` // 默认档位，为空不限制
+	UserPolicies      map[string]PolicyCfg     `json:"user_policies,omitempty"`
+	FFmpeg            string                   `json:"ffmpeg,omitempty"` // ffmpeg 可执行文件，默认从 PATH 查找
+	TranscodeProfiles map[string]TranscodeCfg  `json:"transcode_profiles,omitempty"`
+	Snapshot          SnapshotCfg              `json:"snapshot"`
+	Recording         RecordingCfg             `json:"recording"`
+	Maintenance       MaintenanceCfg           `json:"maintenance"`
+	Fallback          FallbackCfg              `json:"fallback"`
+	Probe             ProbeCfg                 `json:"probe"`
+	Quota             QuotaCfg                 `json:"quota"`
+	Timezone          string                   `json:"timezone,omitempty"` // 访问时段使用的时区（IANA 名称），默认本地时区
+	Cluster           ClusterCfg               `json:"cluster"`
+	HA                HACfg                    `json:"ha"`
+	Upstream          UpstreamCfg              `json:"upstream"`
+	Gzip              GzipCfg                  `json:"gzip"`
+	SessionLimit      SessionLimitCfg          `json:"session_limit"`
+	SSRF              SSRFCfg                  `json:"ssrf"`
+	DLNA              DLNACfg                  `json:"dlna"`
+
+	trustedProxies []netip.Prefix // 由 TrustedProxies 解析
+	ssrfPrefixes   []netip.Prefix // 由 SSRF.Allow 解析
+	ssrfHosts      []string
+	dlnaPrefixes   []netip.Prefix // 由 DLNA.Allow 解析
+	tenant         string         // 租户视图所属租户，顶层配置为空
+	tenantViews    *tenantViews
+	loc            *time.Location // 由 Timezone 解析
+}
+
+// 用户
+type UserCfg struct {
+	Password string `json:"password"`
+	Disabled bool   `json:"disabled,omitempty"` // 禁用后内置认证不再通过
+}
+
+// 用户组：成员 + 组级策略（未设置的项沿用全局）
+type GroupCfg struct {
+	Users        []string         `json:"users"`
+	Backpressure *BackpressureCfg `json:"backpressure,omitempty"`
+	PolicyCfg
+}
+
+// 用户级策略（user_policies），也可写在用户组上作为组级默认；优先级：用户 > 用户组 > 全局
+type PolicyCfg struct {
+	ABRProfile        string        `json:"abr_profile,omitempty"`
+	Preview           *PreviewCfg   `json:"preview,omitempty"`
+	RecordQuotaMB     int           `json:"record_quota_mb,omitempty"`    // 覆盖 recording.quota_mb
+	QuotaGB           float64       `json:"quota_gb,omitempty"`           // 覆盖 quota.gb
+	Schedule          []ScheduleCfg `json:"schedule,omitempty"`           // 允许访问的时段，为空不限
+	BlockedCategories []string      `json:"blocked_categories,omitempty"` // 家长控制：屏蔽的频道分类
+	PIN               string        `json:"pin,omitempty"`                // 请求带 pin= 时解除屏蔽；为空则无法解除
+	MaxSessionSec     int           `json:"max_session_sec,omitempty"`    // 覆盖 session_limit.max_sec
+}
+
+// 试看：在 channels（为空 = 全部）上从首次播放起可看 seconds 秒（断线重连不重新计时），
+// 到时断开并追加 slate；cooldown_sec 内再次请求返回 403 + message
+type PreviewCfg struct {
+	Seconds     int      `json:"seconds"`
+	CooldownSec int      `json:"cooldown_sec,omitempty"` // 默认 86400
+	Channels    []string `json:"channels,omitempty"`
+	Slate       string   `json:"slate,omitempty"`   // 到时追加输出的 TS 文件
+	Message     string   `json:"message,omitempty"` // 冷却期内拒绝时的提示
+}
+
+func (p PreviewCfg) Cooldown() time.Duration {
+	return time.Duration(cmp.Or(max(p.CooldownSec, 0), 86400)) * time.Second
+}
+
+// ABR 档位：限制主播放列表（HLS master / DASH MPD）中保留的码率与分辨率
+type ABRProfileCfg struct {
+	MaxBandwidth int `json:"max_bandwidth,omitempty"` // bps，0 = 不限
+	MaxHeight    int `json:"max_height,omitempty"`    // 像素，0 = 不限
+}
+
+// Allows 未知的码率/分辨率（0）不受对应限制
+func (a ABRProfileCfg) Allows(bandwidth, height int) bool {
+	return (a.MaxBandwidth == 0 || bandwidth <= a.MaxBandwidth) &&
+		(a.MaxHeight == 0 || height <= a.MaxHeight)
+}
+
+// 频道目录：/stream?channel=<name> 映射到上游 path
+type ChannelCfg struct {
+	Path          string           `json:"path"`
+	DowngradePath string           `json:"downgrade_path,omitempty"` // 低码率备选，供 downgrade 策略使用
+	Backpressure  *BackpressureCfg `json:"backpressure,omitempty"`
+	Flush         *FlushCfg        `json:"flush,omitempty"`
+	Pacing        *PacingCfg       `json:"pacing,omitempty"`
+	Fallback      *FallbackCfg     `json:"fallback,omitempty"`
+	Transcode     string           `json:"transcode,omitempty"` // 转码档位名，为空直接转发
+	Users         []string         `json:"users,omitempty"`     // 非空时仅允许这些用户或 groups 成员观看
+	Groups        []string         `json:"groups,omitempty"`
+	Categories    []string         `json:"categories,omitempty"`      // 分类标签，供家长控制使用
+	MaxSessionSec int              `json:"max_session_sec,omitempty"` // 单次会话时长上限，与用户上限取较小者
+}
+
+// 背压策略：客户端跟不上源码率时的处理方式
+const (
+	BackpressureBlock      = "block"      // 阻塞上游读取（默认）
+	BackpressureDowngrade  = "downgrade"  // 切换到频道的 downgrade_path，并从关键帧续播
+	BackpressureSkip       = "skip"       // 丢弃积压数据，跳到下一个关键帧
+	BackpressureDisconnect = "disconnect" // 直接断开客户端
+)
+
+type BackpressureCfg struct {
+	Policy   string `json:"policy,omitempty"`
+	BufferKB int    `json:"buffer_kb,omitempty"` // 读写之间的排队上限
+	StallMS  int    `json:"stall_ms,omitempty"`  // 队列满持续多久视为拥塞
+}
+
+// 显式刷新：达到字节阈值立即 Flush，否则最迟 IntervalMS 后 Flush；全为 0 时沿用隐式缓冲
+type FlushCfg struct {
+	IntervalMS int `json:"interval_ms,omitempty"`
+	Bytes      int `json:"bytes,omitempty"`
+}
+
+// 转码档位：ffmpeg 的输出参数；输入固定为上游数据（stdin），输出固定为 MPEG-TS（stdout）
+type TranscodeCfg struct {
+	Args []string `json:"args"` // 如 ["-c:v", "libx264", "-preset", "veryfast", "-c:a", "aac"]
+}
+
+func (c *Config) FFmpegPath() string {
+	return cmp.Or(c.FFmpeg, "ffmpeg")
+}
+
+// 频道截图（/snapshot?channel=）：ffmpeg 截取一帧 JPEG 并缓存
+type SnapshotCfg struct {
+	TTLSec     int `json:"ttl_sec,omitempty"`     // 缓存时长，默认 30
+	TimeoutSec int `json:"timeout_sec,omitempty"` // 单次截图超时，默认 10
+	Width      int `json:"width,omitempty"`       // 缩放到的宽度，0 = 原始尺寸
+	MaxWorkers int `json:"max_workers,omitempty"` // 同时运行的截图进程上限，默认 2
+}
+
+func (s SnapshotCfg) TTL() time.Duration {
+	return time.Duration(cmp.Or(max(s.TTLSec, 0), 30)) * time.Second
+}
+
+func (s SnapshotCfg) Timeout() time.Duration {
+	return time.Duration(cmp.Or(max(s.TimeoutSec, 0), 10)) * time.Second
+}
+
+func (s SnapshotCfg) Workers() int {
+	return cmp.Or(max(s.MaxWorkers, 0), 2)
+}
+
+// 按需录制：用户通过 /recordings 接口录制频道到 dir/<租户>/<用户>/；dir 为空时关闭
+type RecordingCfg struct {
+	Dir            string `json:"dir,omitempty"`
+	QuotaMB        int    `json:"quota_mb,omitempty"`         // 每用户空间配额，默认 1024
+	MaxDurationSec int    `json:"max_duration_sec,omitempty"` // 单次录制时长上限，默认 14400
+	MaxActive      int    `json:"max_active,omitempty"`       // 每用户同时录制数，默认 2
+}
+
+func (r RecordingCfg) MaxDuration() time.Duration {
+	return time.Duration(cmp.Or(max(r.MaxDurationSec, 0), 14400)) * time.Second
+}
+
+func (r RecordingCfg) Active() int {
+	return cmp.Or(max(r.MaxActive, 0), 2)
+}
+
+// 维护模式的响应（开关在管理接口 /admin/maintenance）
+type MaintenanceCfg struct {
+	Status        int    `json:"status,omitempty"`  // 默认 503
+	Message       string `json:"message,omitempty"` // 默认 "Service under maintenance"
+	Slate         string `json:"slate,omitempty"`   // 设置后以 200 返回该 TS 文件代替错误
+	RetryAfterSec int    `json:"retry_after_sec,omitempty"`
+}
+
+func (m MaintenanceCfg) StatusCode() int {
+	if m.Status < 400 || m.Status > 599 {
+		return 503
+	}
+	return m.Status
+}
+
+// 上游故障备用画面：上游不可达、中途断开或卡住时循环输出 slate（TS 文件），
+// 每 retry_sec 秒重连一次，恢复后从关键帧切回；slate 为空时关闭
+type FallbackCfg struct {
+	Slate    string `json:"slate,omitempty"`
+	RetrySec int    `json:"retry_sec,omitempty"` // 默认 5
+	StallSec int    `json:"stall_sec,omitempty"` // 上游无数据超过该时长即切换，默认 5
+	MaxKbps  int    `json:"max_kbps,omitempty"`  // slate 输出码率上限（slate 无 PCR 时生效），默认 4000
+}
+
+func (f FallbackCfg) Retry() time.Duration {
+	return time.Duration(cmp.Or(max(f.RetrySec, 0), 5)) * time.Second
+}
+
+func (f FallbackCfg) Stall() time.Duration {
+	return time.Duration(cmp.Or(max(f.StallSec, 0), 5)) * time.Second
+}
+
+func (f FallbackCfg) Kbps() int {
+	return cmp.Or(max(f.MaxKbps, 0), 4000)
+}
+
+// 频道可用性探测：interval_sec > 0 时后台定时探测所有频道，结果见 /admin/probe 与指标
+type ProbeCfg struct {
+	IntervalSec int `json:"interval_sec,omitempty"`
+	TimeoutSec  int `json:"timeout_sec,omitempty"` // 单个频道超时，默认 5
+	Concurrency int `json:"concurrency,omitempty"` // 同时探测的频道数，默认 4
+}
+
+func (p ProbeCfg) Interval() time.Duration {
+	return time.Duration(max(p.IntervalSec, 0)) * time.Second
+}
+
+func (p ProbeCfg) Timeout() time.Duration {
+	return time.Duration(cmp.Or(max(p.TimeoutSec, 0), 5)) * time.Second
+}
+
+func (p ProbeCfg) Workers() int {
+	return cmp.Or(max(p.Concurrency, 0), 4)
+}
+
+// 流量配额动作
+const (
+	QuotaBlock    = "block"    // 超出后拒绝新请求并断开进行中的流（默认）
+	QuotaThrottle = "throttle" // 超出后限速到 throttle_kbps
+)
+
+// 流量配额：按计费周期统计每个用户发送给客户端的字节数，周期从每月 reset_day 日 0 点开始
+type QuotaCfg struct {
+	GB           float64 `json:"gb,omitempty"` // 每周期配额，0 = 不限
+	Action       string  `json:"action,omitempty"`
+	ThrottleKbps int     `json:"throttle_kbps,omitempty"` // 默认 1000
+	ResetDay     int     `json:"reset_day,omitempty"`     // 1-28，默认 1
+	StateFile    string  `json:"state_file,omitempty"`    // 用量持久化文件，为空时仅保存在内存
+}
+
+func (q QuotaCfg) Kbps() int {
+	return cmp.Or(max(q.ThrottleKbps, 0), 1000)
+}
+
+// PeriodStart 返回 t 所在计费周期的起始时间（t 所在时区）
+func (q QuotaCfg) PeriodStart(t time.Time) time.Time {
+	day := min(max(q.ResetDay, 1), 28)
+	start := time.Date(t.Year(), t.Month(), day, 0, 0, 0, 0, t.Location())
+	if t.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// QuotaPeriodStart 按 timezone 计算 t 所在计费周期的起始时间，与访问时段使用同一时区
+func (c *Config) QuotaPeriodStart(t time.Time) time.Time {
+	return c.Quota.PeriodStart(t.In(c.Location()))
+}
+
+// 集群：节点间通过 HTTP 定时交换会话数与流量用量，并转发踢人/配额清零命令；
+// peers 为其它节点的地址（可包含自身，会被识别并跳过），所有节点须配置相同的 secret
+type ClusterCfg struct {
+	Node       string   `json:"node,omitempty"` // 节点名，默认主机名
+	Peers      []string `json:"peers,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+	IntervalMS int      `json:"interval_ms,omitempty"` // 同步周期，默认 1000
+}
+
+func (c ClusterCfg) Interval() time.Duration {
+	return time.Duration(cmp.Or(max(c.IntervalMS, 0), 1000)) * time.Millisecond
+}
+
+// 主备角色
+const (
+	HAPrimary = "primary"
+	HAStandby = "standby"
+)
+
+// 主备高可用：standby 持续从 primary 同步配置文件（保留自身的 ha 与 listen）、会话、维护状态与流量用量；
+// 待机期间 /health 返回 503 且拒绝新流，primary 连续 fail_after 次检查失败后接管，primary 恢复后交还
+type HACfg struct {
+	Role            string   `json:"role,omitempty"` // 为空关闭
+	Peer            string   `json:"peer,omitempty"` // standby 使用：primary 的地址
+	Secret          string   `json:"secret,omitempty"`
+	CheckIntervalMS int      `json:"check_interval_ms,omitempty"` // 默认 1000
+	FailAfter       int      `json:"fail_after,omitempty"`        // 默认 3
+	OnActive        []string `json:"on_active,omitempty"`         // 成为活动节点时执行（如绑定虚拟 IP），首项为可执行文件
+	OnStandby       []string `json:"on_standby,omitempty"`
+}
+
+func (h HACfg) Interval() time.Duration {
+	return time.Duration(cmp.Or(max(h.CheckIntervalMS, 0), 1000)) * time.Millisecond
+}
+
+func (h HACfg) Failures() int {
+	return cmp.Or(max(h.FailAfter, 0), 3)
+}
+
+// 连接上游的地址族：auto（系统默认顺序）、ipv4、ipv6、prefer_ipv4、prefer_ipv6；
+// auto 与 prefer_* 均使用 Happy Eyeballs：首选地址族 fallback_delay_ms 内未连上时并行尝试另一个
+type UpstreamCfg struct {
+	AddressFamily   string `json:"address_family,omitempty"`
+	FallbackDelayMS int    `json:"fallback_delay_ms,omitempty"` // 默认 300，<0 关闭并行（首选失败后再试另一个）
+}
+
+func (u UpstreamCfg) FallbackDelay() time.Duration {
+	if u.FallbackDelayMS < 0 {
+		return -1
+	}
+	return time.Duration(cmp.Or(u.FallbackDelayMS, 300)) * time.Millisecond
+}
+
+// 输出限速：source 按 TS 中的 PCR 以源码率输出；max_kbps 为码率上限，可单独使用
+type PacingCfg struct {
+	Source  bool `json:"source,omitempty"`
+	MaxKbps int  `json:"max_kbps,omitempty"`
+	LeadMS  int  `json:"lead_ms,omitempty"` // 允许超前的量（起播缓冲），默认 2000
+}
+
+func (p PacingCfg) Lead() time.Duration {
+	if p.LeadMS <= 0 {
+		return 2 * time.Second
+	}
+	return time.Duration(p.LeadMS) * time.Millisecond
+}
+
+// 并发准入：超过 MaxStreams 时短暂排队，排不上则 503 + Retry-After
+type AdmissionCfg struct {
+	MaxStreams     int `json:"max_streams,omitempty"`      // 0 = 不限
+	QueueSize      int `json:"queue_size,omitempty"`       // 最多排队请求数，0 = 不排队
+	QueueTimeoutMS int `json:"queue_timeout_ms,omitempty"` // 排队最长等待
+	RetryAfterSec  int `json:"retry_after_sec,omitempty"`  // 默认 5
+}
+
+// 空闲检测：对上游的一次读取挂起超过 TimeoutSec 视为死流（客户端慢导致的阻塞不计入）
+type IdleCfg struct {
+	TimeoutSec       int `json:"timeout_sec,omitempty"`        // 0 = 关闭
+	CheckIntervalSec int `json:"check_interval_sec,omitempty"` // 默认 5
+}
+
+// 客户端请求头透传策略；名称不区分大小写，"X-*" 形式为前缀通配
+type RequestHeadersCfg struct {
+	Forward []string `json:"forward,omitempty"` // 默认不透传任何请求头
+}
+
+// gzip：上游响应始终由代理请求并解压；clients 开启后对接受 gzip 的客户端重新压缩文本响应
+// （HLS/DASH 清单、EPG、JSON），TS 等媒体数据永不压缩
+type GzipCfg struct {
+	Clients  bool `json:"clients,omitempty"`
+	Level    int  `json:"level,omitempty"`     // 1-9，默认 6
+	MinBytes int  `json:"min_bytes,omitempty"` // 长度已知且小于此值时不压缩，默认 512
+}
+
+func (g GzipCfg) CompressionLevel() int {
+	if g.Level < 1 || g.Level > 9 {
+		return 6
+	}
+	return g.Level
+}
+
+func (g GzipCfg) Min() int {
+	return cmp.Or(max(g.MinBytes, 0), 512)
+}
+
+// 单次会话时长上限：到时断开，回收无人观看的常开设备占用的会话；
+// reauth 为 true 时同时丢弃该用户的认证缓存，重连须重新经认证插件校验
+type SessionLimitCfg struct {
+	MaxSec int  `json:"max_sec,omitempty"` // 0 = 不限
+	Reauth bool `json:"reauth,omitempty"`
+}
+
+// 上游响应头回传策略；Forward 未配置时使用 DefaultResponseHeaders，配置为 [] 则全部丢弃
+type ResponseHeadersCfg struct {
+	Forward []string `json:"forward,omitempty"`
+}
+
+var DefaultResponseHeaders = []string{
+	"Content-Length", "Content-Range", "Accept-Ranges", "Cache-Control", "Expires",
+	"ETag", "Last-Modified", "Age", "Vary", "X-*",
+}
+
+// 小响应缓存：按路径后缀匹配（播放列表、EPG、频道列表等），TTL 内直接返回，
+// 过期后 StaleMS 内先返回旧内容并后台刷新
+type CacheCfg struct {
+	Enabled    bool     `json:"enabled,omitempty"`
+	TTLMS      int      `json:"ttl_ms,omitempty"`       // 默认 1000
+	StaleMS    int      `json:"stale_ms,omitempty"`     // 默认 0（不返回过期内容）
+	MaxEntryKB int      `json:"max_entry_kb,omitempty"` // 单条上限，默认 512
+	MaxEntries int      `json:"max_entries,omitempty"`  // 默认 1024
+	Suffixes   []string `json:"suffixes,omitempty"`     // 默认 .m3u8 .m3u .mpd .xml .json
+}
+
+// /health 输出级别
+const (
+	HealthMinimal = "minimal"
+	HealthBasic   = "basic"
+	HealthFull    = "full"
+)
+
+// 未携带管理凭据时 /health 的输出级别，默认 minimal
+type HealthCfg struct {
+	PublicDetail string `json:"public_detail,omitempty"`
+}
+
+// 按客户端 IP 的令牌桶限流；RPS 为 0 时关闭
+type RateLimitCfg struct {
+	RPS   float64 `json:"rps,omitempty"`
+	Burst int     `json:"burst,omitempty"` // 默认 max(1, RPS)
+}
+
+// path 参数改写：Match 为正则，Replace 支持 $1 引用
+type RewriteRule struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// 外部插件：每次调用执行一次 Exec，stdin 传入事件 JSON，stdout 返回 {"allow":bool,"reason":"..."}
+// Args 与 Env 的值可使用 text/template，字段同事件（.User .Channel .Reason 等）
+type PluginCfg struct {
+	Name          string            `json:"name"`
+	Exec          string            `json:"exec"`
+	Args          []string          `json:"args,omitempty"`
+	Env           map[string]string `json:"env,omitempty"`            // 追加的环境变量
+	Hooks         []string          `json:"hooks"`                    // authenticate | authorize | session_start | session_end
+	TimeoutMS     int               `json:"timeout_ms,omitempty"`     // 默认 2000
+	CacheSec      int               `json:"cache_sec,omitempty"`      // authenticate 结果缓存时长，0 = 不缓存
+	FailOpen      bool              `json:"fail_open,omitempty"`      // authorize 插件出错时放行
+	MaxConcurrent int               `json:"max_concurrent,omitempty"` // 同时运行的进程数上限，0 = 不限；排队超过 timeout 则放弃
+}
+
+func (p PluginCfg) Timeout() time.Duration {
+	if p.TimeoutMS <= 0 {
+		return 2 * time.Second
+	}
+	return time.Duration(p.TimeoutMS) * time.Millisecond
+}
+
+// 脚本钩子：Lua 脚本文件路径，文件修改后自动重新加载
+type ScriptsCfg struct {
+	RewriteURL string `json:"rewrite_url,omitempty"` // 返回新的上游 URL，空结果不改写
+	Auth       string `json:"auth,omitempty"`        // 返回 allow / deny，其它结果交给内置认证
+	Headers    string `json:"headers,omitempty"`     // 设置或删除上游请求头
+}
+
+// 会话历史：会话结束时追加到 dir 下按天切分的 JSONL 文件
+type HistoryCfg struct {
+	Dir           string `json:"dir,omitempty"`            // 为空时关闭
+	RetentionDays int    `json:"retention_days,omitempty"` // 默认 30
+}
+
+// 断线续播：客户端断开后上游保留 window_sec 秒，期间同一用户重连同一上游时直接接管
+type ResumeCfg struct {
+	WindowSec int `json:"window_sec,omitempty"` // 0 = 关闭
+	BufferKB  int `json:"buffer_kb,omitempty"`  // 暂存期间保留的最新数据，默认 2048
+}
+
+func (r ResumeCfg) Window() time.Duration {
+	return time.Duration(r.WindowSec) * time.Second
+}
+
+func (r ResumeCfg) BufferBytes() int {
+	if r.BufferKB <= 0 {
+		return 2048 << 10
+	}
+	return r.BufferKB << 10
+}
+
+// 管理接口（/admin/*）凭据；Token 为空时管理接口关闭
+type AdminCfg struct {
+	Token string `json:"token,omitempty"`
+}
+
+// 客户端查询参数透传：none（默认）| all（除代理自身参数外全部）| allow（仅 Allow 列表）
+type QueryCfg struct {
+	Mode  string   `json:"mode,omitempty"`
+	Allow []string `json:"allow,omitempty"`
+}
+
+// Normalize 填充默认值并解析派生字段；Load 会自动调用，代码中直接构造的 Config 需手动调用
+func (c *Config) Normalize() {
+	if c.Listen.Host == "" {
+		c.Listen.Host = "0.0.0.0"
+	}
+	if c.Listen.Port == 0 {
+		c.Listen.Port = 8000
+	}
+	if c.Users == nil {
+		c.Users = map[string]UserCfg{}
+	}
+	c.Backpressure = c.Backpressure.WithDefaults()
+	if c.ResponseHeaders.Forward == nil {
+		c.ResponseHeaders.Forward = DefaultResponseHeaders
+	}
+	c.trustedProxies = parseTrustedProxies(c.TrustedProxies)
+	c.Cache = c.Cache.withDefaults()
+	c.normalizeTenants()
+	c.normalizeSchedules()
+	c.normalizeSSRF()
+	c.normalizeDLNA()
+	for user, pol := range c.UserPolicies {
+		if _, ok := c.ABRProfiles[pol.ABRProfile]; pol.ABRProfile != "" && !ok {
+			log.Printf("[StreamProxy] 用户 %s 的 abr_profile %q 未定义，不做限制", user, pol.ABRProfile)
+		}
+	}
+	switch c.Health.PublicDetail {
+	case HealthMinimal, HealthBasic, HealthFull:
+	default:
+		c.Health.PublicDetail = HealthMinimal
+	}
+}
+
+func (c CacheCfg) withDefaults() CacheCfg {
+	if c.TTLMS <= 0 {
+		c.TTLMS = 1000
+	}
+	if c.StaleMS < 0 {
+		c.StaleMS = 0
+	}
+	if c.MaxEntryKB <= 0 {
+		c.MaxEntryKB = 512
+	}
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = 1024
+	}
+	if c.Suffixes == nil {
+		c.Suffixes = []string{".m3u8", ".m3u", ".mpd", ".xml", ".json"}
+	}
+	return c
+}
+
+func (b BackpressureCfg) WithDefaults() BackpressureCfg {
+	switch b.Policy {
+	case BackpressureBlock, BackpressureDowngrade, BackpressureSkip, BackpressureDisconnect:
+	case "":
+		b.Policy = BackpressureBlock
+	default:
+		log.Printf("[StreamProxy] 未知背压策略 %q，按 block 处理", b.Policy)
+		b.Policy = BackpressureBlock
+	}
+	if b.BufferKB <= 0 {
+		b.BufferKB = 2048
+	}
+	if b.StallMS <= 0 {
+		b.StallMS = 2000
+	}
+	return b
+}
+
+func (a AdmissionCfg) RetryAfter() int {
+	if a.RetryAfterSec <= 0 {
+		return 5
+	}
+	return a.RetryAfterSec
+}
+
+// GroupsOf 返回用户所属的组名（按名称排序，组级策略取第一个命中的组）
+func (c *Config) GroupsOf(user string) []string {
+	var out []string
+	for name, g := range c.Groups {
+		if slices.Contains(g.Users, user) {
+			out = append(out, name)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// CanWatch 频道访问控制；未设置 users/groups 的频道对所有用户开放
+func (c *Config) CanWatch(user string, ch ChannelCfg) bool {
+	if len(ch.Users) == 0 && len(ch.Groups) == 0 {
+		return true
+	}
+	if slices.Contains(ch.Users, user) {
+		return true
+	}
+	for _, g := range ch.Groups {
+		if slices.Contains(c.Groups[g].Users, user) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanWatchPath 按 path 直接请求时的访问控制：path 属于受限频道时，用户须能观看其中之一
+func (c *Config) CanWatchPath(user, path string) bool {
+	chs := c.ChannelsForPath(path)
+	return len(chs) == 0 || slices.ContainsFunc(chs, func(ch ChannelCfg) bool { return c.CanWatch(user, ch) })
+}
+
+// ChannelsForPath 返回上游 path（或降档 path）为 path 的频道；按规范化后的路径比较
+func (c *Config) ChannelsForPath(path string) []ChannelCfg {
+	var out []ChannelCfg
+	for _, name := range c.ChannelNamesForPath(path) {
+		out = append(out, c.Channels[name])
+	}
+	return out
+}
+
+// ChannelNamesForPath 返回 path 对应的频道名（按名称排序）
+func (c *Config) ChannelNamesForPath(path string) []string {
+	key := pathKey(path)
+	var out []string
+	for n, ch := range c.Channels {
+		if ch.servesPath(key) {
+			out = append(out, n)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// ChannelNameForPath 返回 path 对应的频道名（多个时取名称最小者），没有则为空
+func (c *Config) ChannelNameForPath(path string) string {
+	if names := c.ChannelNamesForPath(path); len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
+
+// ParentalBlocked 频道是否因分类被家长控制屏蔽；pin 为解除屏蔽用的 PIN（为空不可解除）。
+// 屏蔽分类与 PIN 各自按 用户 > 用户组 取第一个设置的值
+func (c *Config) ParentalBlocked(user string, ch ChannelCfg) (blocked bool, pin string) {
+	pol := c.UserPolicies[user]
+	blockedCats, pin := pol.BlockedCategories, pol.PIN
+	for _, g := range c.GroupsOf(user) {
+		if len(blockedCats) == 0 {
+			blockedCats = c.Groups[g].BlockedCategories
+		}
+		pin = cmp.Or(pin, c.Groups[g].PIN)
+	}
+	for _, cat := range ch.Categories {
+		if slices.Contains(blockedCats, cat) {
+			return true, pin
+		}
+	}
+	return false, pin
+}
+
+// BackpressureFor 优先级：频道 > 用户组 > 全局
+func (c *Config) BackpressureFor(user string, ch *ChannelCfg) BackpressureCfg {
+	if ch != nil && ch.Backpressure != nil {
+		return ch.Backpressure.WithDefaults()
+	}
+	for _, g := range c.GroupsOf(user) {
+		if bp := c.Groups[g].Backpressure; bp != nil {
+			return bp.WithDefaults()
+		}
+	}
+	return c.Backpressure
+}
+
+// ABRProfileFor 优先级：用户 > 用户组 > 全局；无档位时 ok 为 false
+func (c *Config) ABRProfileFor(user string) (ABRProfileCfg, bool) {
+	name := c.UserPolicies[user].ABRProfile
+	for _, g := range c.GroupsOf(user) {
+		if name != "" {
+			break
+		}
+		name = c.Groups[g].ABRProfile
+	}
+	name = cmp.Or(name, c.ABRProfile)
+	if name == "" {
+		return ABRProfileCfg{}, false
+	}
+	prof, ok := c.ABRProfiles[name]
+	return prof, ok
+}
+
+// QuotaFor 返回用户每周期的流量配额（字节），0 = 不限；优先级：用户 > 用户组 > 全局
+func (c *Config) QuotaFor(user string) int64 {
+	gb := c.UserPolicies[user].QuotaGB
+	for _, g := range c.GroupsOf(user) {
+		if gb > 0 {
+			break
+		}
+		gb = c.Groups[g].QuotaGB
+	}
+	gb = cmp.Or(max(gb, 0), max(c.Quota.GB, 0))
+	return int64(gb * (1 << 30))
+}
+
+// PreviewFor 优先级：用户 > 用户组；channel 为空时（path 不属于任何频道）仅匹配不限频道的试看
+func (c *Config) PreviewFor(user, channel string) (PreviewCfg, bool) {
+	pv := c.UserPolicies[user].Preview
+	for _, g := range c.GroupsOf(user) {
+		if pv != nil {
+			break
+		}
+		pv = c.Groups[g].Preview
+	}
+	if pv == nil || pv.Seconds <= 0 {
+		return PreviewCfg{}, false
+	}
+	if len(pv.Channels) > 0 && !slices.Contains(pv.Channels, channel) {
+		return PreviewCfg{}, false
+	}
+	return *pv, true
+}
+
+// RecordQuotaFor 返回用户录制配额（字节），优先级：用户 > 用户组 > 全局
+func (c *Config) RecordQuotaFor(user string) int64 {
+	mb := c.UserPolicies[user].RecordQuotaMB
+	for _, g := range c.GroupsOf(user) {
+		if mb > 0 {
+			break
+		}
+		mb = c.Groups[g].RecordQuotaMB
+	}
+	return int64(cmp.Or(max(mb, 0), max(c.Recording.QuotaMB, 0), 1024)) << 20
+}
+
+// MaxSessionFor 返回会话时长上限，0 为不限。用户上限优先级：用户 > 用户组 > 全局，频道上限另行生效，取较小值；
+// 按 path 播放时 chs 为该路径对应的全部频道
+func (c *Config) MaxSessionFor(user string, chs ...ChannelCfg) time.Duration {
+	sec := c.UserPolicies[user].MaxSessionSec
+	for _, g := range c.GroupsOf(user) {
+		if sec > 0 {
+			break
+		}
+		sec = c.Groups[g].MaxSessionSec
+	}
+	sec = cmp.Or(max(sec, 0), max(c.SessionLimit.MaxSec, 0))
+	for _, ch := range chs {
+		if ch.MaxSessionSec > 0 && (sec == 0 || ch.MaxSessionSec < sec) {
+			sec = ch.MaxSessionSec
+		}
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// FlushFor 优先级：频道 > 全局
+func (c *Config) FlushFor(ch *ChannelCfg) FlushCfg {
+	if ch != nil && ch.Flush != nil {
+		return *ch.Flush
+	}
+	return c.Flush
+}
+
+// FallbackFor 优先级：频道 > 全局
+func (c *Config) FallbackFor(ch *ChannelCfg) FallbackCfg {
+	if ch != nil && ch.Fallback != nil {
+		return *ch.Fallback
+	}
+	return c.Fallback
+}
+
+// PacingFor 优先级：频道 > 全局
+func (c *Config) PacingFor(ch *ChannelCfg) PacingCfg {
+	if ch != nil && ch.Pacing != nil {
+		return *ch.Pacing
+	}
+	return c.Pacing
+}
+
+// TrustedProxyPrefixes 返回解析后的 trusted_proxies
+func (c *Config) TrustedProxyPrefixes() []netip.Prefix {
+	return c.trustedProxies
+}
+
+// 解析 trusted_proxies：支持单个 IP 或 CIDR
+func parseTrustedProxies(list []string) []netip.Prefix {
+	return parsePrefixes("trusted_proxies", list)
+}
+
+// 解析 IP / CIDR 列表，field 用于日志
+func parsePrefixes(field string, list []string) []netip.Prefix {
+	out := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if p, err := netip.ParsePrefix(s); err == nil {
+			out = append(out, p.Masked())
+		} else if a, err := netip.ParseAddr(s); err == nil {
+			out = append(out, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+		} else {
+			log.Printf("[StreamProxy] 忽略无效的 %s 项 %q", field, s)
+		}
+	}
+	return out
+}
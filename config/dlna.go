@@ -0,0 +1,51 @@
+package config
+
+import (
+	"cmp"
+	"net/netip"
+	"time"
+)
+
+// DLNA：通过 SSDP 在局域网宣告为媒体服务器，频道列表按 user 的权限生成。
+// /dlna/ 接口与 DLNA 播放地址只接受局域网（私有、回环、链路本地）及 allow 中的来源；
+// 播放地址携带 token 而不是用户密码，token 仅可用于按 channel 播放，修改后旧地址立即失效
+type DLNACfg struct {
+	Enabled           bool     `json:"enabled,omitempty"`
+	User              string   `json:"user,omitempty"`
+	Token             string   `json:"token,omitempty"`               // 为空时每次启动随机生成
+	Allow             []string `json:"allow,omitempty"`               // 额外放行的来源 IP 或 CIDR
+	FriendlyName      string   `json:"friendly_name,omitempty"`       // 电视上显示的名称，默认 "Stream Proxy"
+	UUID              string   `json:"uuid,omitempty"`                // 默认由主机名与端口生成
+	AdvertiseHost     string   `json:"advertise_host,omitempty"`      // 宣告的地址，默认取面向客户端的本机 IP
+	NotifyIntervalSec int      `json:"notify_interval_sec,omitempty"` // ssdp:alive 广播间隔，默认 300
+}
+
+func (d DLNACfg) Name() string {
+	return cmp.Or(d.FriendlyName, "Stream Proxy")
+}
+
+func (d DLNACfg) NotifyInterval() time.Duration {
+	return time.Duration(cmp.Or(max(d.NotifyIntervalSec, 0), 300)) * time.Second
+}
+
+func (c *Config) normalizeDLNA() {
+	c.dlnaPrefixes = parsePrefixes("dlna.allow", c.DLNA.Allow)
+}
+
+// DLNAAllowed 来源地址是否可访问 DLNA 接口
+func (c *Config) DLNAAllowed(ip string) bool {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	a = a.Unmap()
+	if a.IsPrivate() || a.IsLoopback() || a.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, p := range c.dlnaPrefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
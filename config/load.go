@@ -0,0 +1,59 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// EnsureDefault 在配置文件不存在时写入一份默认配置
+func EnsureDefault(path string) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		def := Config{
+			Listen:     ListenCfg{Host: "0.0.0.0", Port: 8000},
+			StreamHost: "http://127.0.0.1:8080",
+			Version:    CurrentVersion,
+			Users:      map[string]UserCfg{"test": {Password: "123456"}},
+		}
+		if dir := filepath.Dir(filepath.Clean(path)); dir != "." {
+			_ = os.MkdirAll(dir, 0o755)
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(def)
+	}
+	return nil
+}
+
+// Load 读取并规范化配置文件，同时返回其修改时间
+func Load(path string) (cfg *Config, mtimeNS int64, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, from, err := Migrate(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if from < CurrentVersion {
+		log.Printf("[StreamProxy] 配置文件为 v%d，已在内存中升级到 v%d；执行 stream-proxy migrate 可写回文件", from, CurrentVersion)
+	}
+	cfg = &Config{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, 0, err
+	}
+	cfg.Normalize()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return cfg, fi.ModTime().UnixNano(), nil
+}
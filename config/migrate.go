@@ -0,0 +1,89 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// CurrentVersion 当前配置 schema 版本；没有 version 字段的文件视为 1
+const CurrentVersion = 2
+
+// migrations[i] 把 schema 版本 i+1 升级到 i+2，直接操作原始 JSON
+var migrations = []func(doc map[string]json.RawMessage) error{
+	migrateUsersV2,
+}
+
+// Migrate 把旧版配置升级到 CurrentVersion，返回升级后的 JSON 与原版本；已是最新时原样返回
+func Migrate(b []byte) (out []byte, from int, err error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, 0, err
+	}
+	from = 1
+	if v, ok := doc["version"]; ok {
+		if err := json.Unmarshal(v, &from); err != nil {
+			return nil, 0, fmt.Errorf("version: %w", err)
+		}
+	}
+	switch {
+	case from == CurrentVersion:
+		return b, from, nil
+	case from > CurrentVersion:
+		return nil, from, fmt.Errorf("config version %d is newer than supported version %d", from, CurrentVersion)
+	case from < 1:
+		return nil, from, fmt.Errorf("invalid config version %d", from)
+	}
+	for v := from; v < CurrentVersion; v++ {
+		if err := migrations[v-1](doc); err != nil {
+			return nil, from, fmt.Errorf("migrate v%d -> v%d: %w", v, v+1, err)
+		}
+	}
+	doc["version"] = json.RawMessage(strconv.Itoa(CurrentVersion))
+	out, err = json.MarshalIndent(doc, "", "  ")
+	return out, from, err
+}
+
+// v1 -> v2：users（含租户）由 "用户名": "密码" 改为 "用户名": {"password": "密码"}
+func migrateUsersV2(doc map[string]json.RawMessage) error {
+	var err error
+	if raw, ok := doc["users"]; ok {
+		if doc["users"], err = usersV2(raw); err != nil {
+			return fmt.Errorf("users: %w", err)
+		}
+	}
+	raw, ok := doc["tenants"]
+	if !ok {
+		return nil
+	}
+	var tenants map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &tenants); err != nil {
+		return fmt.Errorf("tenants: %w", err)
+	}
+	for name, t := range tenants {
+		if _, ok := t["users"]; !ok {
+			continue
+		}
+		if t["users"], err = usersV2(t["users"]); err != nil {
+			return fmt.Errorf("tenants.%s.users: %w", name, err)
+		}
+	}
+	doc["tenants"], err = json.Marshal(tenants)
+	return err
+}
+
+func usersV2(raw json.RawMessage) (json.RawMessage, error) {
+	var old map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &old); err != nil {
+		return nil, err
+	}
+	users := make(map[string]UserCfg, len(old))
+	for name, v := range old {
+		var pass string
+		if err := json.Unmarshal(v, &pass); err != nil {
+			return nil, fmt.Errorf("%s: password must be a JSON string, got %s", name, v)
+		}
+		users[name] = UserCfg{Password: pass}
+	}
+	return json.Marshal(users)
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+var errBadPath = errors.New("invalid path")
+
+// SplitPathQuery 拆开 path 参数中附带的查询串（如 live/a.ts?token=...），查询串原样转发给上游；
+// 片段（#...）不会发给服务器，直接丢弃。文件名本身含 ? 时须写成 %3F
+func SplitPathQuery(raw string) (p, query string) {
+	raw, _, _ = strings.Cut(raw, "#")
+	p, query, _ = strings.Cut(raw, "?")
+	return p, query
+}
+
+// NormalizePath 规范化客户端请求的上游路径（转义形式，不含 ?、#，须先经 SplitPathQuery）。
+// key 为解码后经 path.Clean 的形式，用于频道匹配与权限判断；escaped 为逐段重新转义的形式，用于拼接上游地址。
+// 两者指向同一资源：空段与 "." 被去掉，出现 ".."（含编码形式）时拒绝
+func NormalizePath(raw string) (key, escaped string, err error) {
+	if strings.ContainsAny(raw, "?#") {
+		return "", "", errBadPath
+	}
+	var segs []string
+	for _, s := range strings.Split(raw, "/") {
+		seg, err := url.PathUnescape(s)
+		if err != nil {
+			return "", "", errBadPath
+		}
+		if seg == "" || seg == "." {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	decoded := strings.Join(segs, "/")
+	// 段内编码的 "/"（%2F）解码后同样不允许构成 ".."
+	if slices.Contains(strings.Split(decoded, "/"), "..") || decoded == "" {
+		return "", "", errBadPath
+	}
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	return strings.TrimPrefix(path.Clean("/"+decoded), "/"), strings.Join(segs, "/"), nil
+}
+
+// 匹配用的路径形式；无法规范化时退回去掉前导 / 的原值（不会与合法路径相等）
+func pathKey(p string) string {
+	if key, _, err := NormalizePath(p); err == nil {
+		return key
+	}
+	return strings.TrimLeft(p, "/")
+}
+
+func (ch ChannelCfg) servesPath(key string) bool {
+	return pathKey(ch.Path) == key || (ch.DowngradePath != "" && pathKey(ch.DowngradePath) == key)
+}
@@ -0,0 +1,79 @@
+package config
+
+import "testing"
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		raw, key, escaped string
+		bad               bool
+	}{
+		{raw: "live/vip.ts", key: "live/vip.ts", escaped: "live/vip.ts"},
+		{raw: "/live/vip.ts", key: "live/vip.ts", escaped: "live/vip.ts"},
+		{raw: "live//vip.ts", key: "live/vip.ts", escaped: "live/vip.ts"},
+		{raw: "./live/vip.ts", key: "live/vip.ts", escaped: "live/vip.ts"},
+		{raw: "live/./vip.ts", key: "live/vip.ts", escaped: "live/vip.ts"},
+		{raw: "live/v%69p.ts", key: "live/vip.ts", escaped: "live/vip.ts"},
+		{raw: "live%2Fvip.ts", key: "live/vip.ts", escaped: "live%2Fvip.ts"},
+		{raw: "live/a%3Fb.ts", key: "live/a?b.ts", escaped: "live/a%3Fb.ts"},
+		{raw: "live/vip.ts?x=1", bad: true}, // path=live/vip.ts%3Fx=1 解码后的值
+		{raw: "live/vip.ts#x", bad: true},
+		{raw: "live/../vip.ts", bad: true},
+		{raw: "live/%2E%2E/vip.ts", bad: true},
+		{raw: "live/..%2Fvip.ts", bad: true},
+		{raw: "live/%zz.ts", bad: true},
+		{raw: "//", bad: true},
+	}
+	for _, tt := range tests {
+		key, esc, err := NormalizePath(tt.raw)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("NormalizePath(%q) = %q, %q; want error", tt.raw, key, esc)
+			}
+			continue
+		}
+		if err != nil || key != tt.key || esc != tt.escaped {
+			t.Errorf("NormalizePath(%q) = %q, %q, %v; want %q, %q", tt.raw, key, esc, err, tt.key, tt.escaped)
+		}
+	}
+}
+
+func TestSplitPathQuery(t *testing.T) {
+	tests := []struct{ raw, path, query string }{
+		{"live/vip.ts", "live/vip.ts", ""},
+		{"live/vip.ts?token=abc&e=1", "live/vip.ts", "token=abc&e=1"},
+		{"live/vip.ts?token=a?b", "live/vip.ts", "token=a?b"},
+		{"live/vip.ts#x", "live/vip.ts", ""},
+		{"live/vip.ts?token=abc#x", "live/vip.ts", "token=abc"},
+		{"live/a%3Fb.ts", "live/a%3Fb.ts", ""},
+	}
+	for _, tt := range tests {
+		p, q := SplitPathQuery(tt.raw)
+		if p != tt.path || q != tt.query {
+			t.Errorf("SplitPathQuery(%q) = %q, %q; want %q, %q", tt.raw, p, q, tt.path, tt.query)
+		}
+	}
+}
+
+func TestCanWatchPathNormalized(t *testing.T) {
+	c := &Config{
+		Channels: map[string]ChannelCfg{
+			"vip":  {Path: "live/vip.ts", Users: []string{"bob"}},
+			"news": {Path: "/live/news.ts"},
+		},
+	}
+	c.Normalize()
+	for _, p := range []string{"live/vip.ts", "/live/vip.ts", "live//vip.ts", "./live/vip.ts", "live/./vip.ts", "live/v%69p.ts", "live%2Fvip.ts"} {
+		if c.CanWatchPath("alice", p) {
+			t.Errorf("alice can watch %q", p)
+		}
+		if !c.CanWatchPath("bob", p) {
+			t.Errorf("bob cannot watch %q", p)
+		}
+		if got := c.ChannelNameForPath(p); got != "vip" {
+			t.Errorf("ChannelNameForPath(%q) = %q", p, got)
+		}
+	}
+	if !c.CanWatchPath("alice", "live//news.ts") {
+		t.Error("alice cannot watch live//news.ts")
+	}
+}
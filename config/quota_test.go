@@ -0,0 +1,27 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaPeriodStartTimezone(t *testing.T) {
+	c := &Config{Timezone: "Asia/Shanghai", Quota: QuotaCfg{ResetDay: 1}}
+	c.Normalize()
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	// UTC 3 月 31 日 20:00 已是上海 4 月 1 日 04:00，属于新的计费周期
+	now := time.Date(2026, 3, 31, 20, 0, 0, 0, time.UTC)
+	want := time.Date(2026, 4, 1, 0, 0, 0, 0, loc)
+	if got := c.QuotaPeriodStart(now); !got.Equal(want) {
+		t.Errorf("QuotaPeriodStart = %v, want %v", got, want)
+	}
+	// 上海 4 月 1 日 00:00 之前仍属于 3 月的周期
+	now = want.Add(-time.Minute)
+	want = time.Date(2026, 3, 1, 0, 0, 0, 0, loc)
+	if got := c.QuotaPeriodStart(now.UTC()); !got.Equal(want) {
+		t.Errorf("QuotaPeriodStart = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// 访问时段：days 为 mon..sun，另可写 weekdays / weekends，为空表示每天；
+// from / to 为 HH:MM（to 可为 24:00），to 不大于 from 时跨午夜，午夜后的部分属于前一天的时段
+type ScheduleCfg struct {
+	Days []string `json:"days,omitempty"`
+	From string   `json:"from"`
+	To   string   `json:"to"`
+}
+
+var weekdayNames = map[string][]time.Weekday{
+	"sun": {time.Sunday}, "mon": {time.Monday}, "tue": {time.Tuesday}, "wed": {time.Wednesday},
+	"thu": {time.Thursday}, "fri": {time.Friday}, "sat": {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+func (s ScheduleCfg) validate() error {
+	for _, d := range s.Days {
+		if _, ok := weekdayNames[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("invalid day %q", d)
+		}
+	}
+	if _, err := parseClock(s.From); err != nil {
+		return err
+	}
+	_, err := parseClock(s.To)
+	return err
+}
+
+func (s ScheduleCfg) onDay(d time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, name := range s.Days {
+		if slices.Contains(weekdayNames[strings.ToLower(name)], d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains 判断 t（已转换到配置时区）是否落在时段内；格式错误的时段不匹配
+func (s ScheduleCfg) Contains(t time.Time) bool {
+	from, err1 := parseClock(s.From)
+	to, err2 := parseClock(s.To)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	m := t.Hour()*60 + t.Minute()
+	if from < to {
+		return s.onDay(t.Weekday()) && m >= from && m < to
+	}
+	return (s.onDay(t.Weekday()) && m >= from) || (s.onDay((t.Weekday()+6)%7) && m < to)
+}
+
+// ScheduleFor 优先级：用户 > 用户组；为空表示不限时段
+func (c *Config) ScheduleFor(user string) []ScheduleCfg {
+	sc := c.UserPolicies[user].Schedule
+	for _, g := range c.GroupsOf(user) {
+		if len(sc) > 0 {
+			break
+		}
+		sc = c.Groups[g].Schedule
+	}
+	return sc
+}
+
+// InSchedule 判断用户此刻是否允许访问
+func (c *Config) InSchedule(user string, now time.Time) bool {
+	sc := c.ScheduleFor(user)
+	if len(sc) == 0 {
+		return true
+	}
+	now = now.In(c.Location())
+	return slices.ContainsFunc(sc, func(s ScheduleCfg) bool { return s.Contains(now) })
+}
+
+// Location 返回 timezone 对应的时区，未配置时为本地时区
+func (c *Config) Location() *time.Location {
+	if c.loc != nil {
+		return c.loc
+	}
+	return time.Local
+}
+
+func (c *Config) normalizeSchedules() {
+	if c.Timezone != "" {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			log.Printf("[StreamProxy] timezone %q 无效，使用本地时区: %v", c.Timezone, err)
+		}
+		c.loc = loc
+	}
+	check := func(owner string, sc []ScheduleCfg) {
+		for _, s := range sc {
+			if err := s.validate(); err != nil {
+				log.Printf("[StreamProxy] %s 的访问时段无效，忽略: %v", owner, err)
+			}
+		}
+	}
+	for user, pol := range c.UserPolicies {
+		check("用户 "+user, pol.Schedule)
+	}
+	for name, g := range c.Groups {
+		check("用户组 "+name, g.Schedule)
+	}
+	for tn, t := range c.Tenants {
+		for user, pol := range t.UserPolicies {
+			check("租户 "+tn+" 用户 "+user, pol.Schedule)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// SSRF 防护：开启后，连接上游时按实际连接的 IP 校验，拒绝回环、私有（RFC 1918 / ULA）、链路本地、CGNAT 等内部地址，
+// 防止经 rewrite_url 脚本、上游重定向等把代理引向内部服务。配置的 stream_host（含租户）视为可信；
+// allow 中的 IP、CIDR 或主机名放行
+type SSRFCfg struct {
+	Enabled bool     `json:"enabled,omitempty"`
+	Allow   []string `json:"allow,omitempty"`
+}
+
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+func (c *Config) normalizeSSRF() {
+	c.ssrfPrefixes, c.ssrfHosts = nil, nil
+	for _, s := range c.SSRF.Allow {
+		s = strings.TrimSpace(s)
+		if p, err := netip.ParsePrefix(s); err == nil {
+			c.ssrfPrefixes = append(c.ssrfPrefixes, p.Masked())
+		} else if a, err := netip.ParseAddr(s); err == nil {
+			c.ssrfPrefixes = append(c.ssrfPrefixes, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+		} else if s != "" && !strings.ContainsAny(s, "/ ") {
+			c.ssrfHosts = append(c.ssrfHosts, strings.ToLower(s))
+		} else {
+			log.Printf("[StreamProxy] 忽略无效的 ssrf.allow 项 %q", s)
+		}
+	}
+}
+
+// TrustedUpstream 判断上游地址（host:port）是否为配置的 stream_host 或 allow 中的主机名，可信地址不做 IP 校验
+func (c *Config) TrustedUpstream(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	if slices.Contains(c.ssrfHosts, host) {
+		return true
+	}
+	hosts := []string{c.StreamHost}
+	for _, t := range c.Tenants {
+		hosts = append(hosts, t.StreamHost)
+	}
+	for _, sh := range hosts {
+		u, err := url.Parse(sh)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		p := u.Port()
+		if p == "" {
+			p = "80"
+			if u.Scheme == "https" {
+				p = "443"
+			}
+		}
+		if strings.ToLower(u.Hostname()) == host && p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// BlockedUpstreamIP 判断 IP 是否属于内部地址且未被 allow 放行
+func (c *Config) BlockedUpstreamIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range c.ssrfPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() ||
+		cgnatPrefix.Contains(ip) || ip.Is4() && ip.As4()[0] == 0
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Source 提供当前生效的配置；proxy 等包只依赖该接口
+type Source interface {
+	Get() *Config
+}
+
+type staticSource struct{ c *Config }
+
+func (s staticSource) Get() *Config { return s.c }
+
+// Static 把固定配置包装成 Source，供嵌入方在代码中直接构造配置
+func Static(c *Config) Source {
+	c.Normalize()
+	return staticSource{c}
+}
+
+// Store 按文件修改时间热加载配置
+type Store struct {
+	path     string
+	override func(*Config)
+
+	cur   atomic.Pointer[Config]
+	mtime atomic.Int64
+	mu    sync.Mutex
+}
+
+// Open 确保配置文件存在并完成首次加载
+func Open(path string) (*Store, error) {
+	if err := EnsureDefault(path); err != nil {
+		return nil, err
+	}
+	cfg, mt, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{path: path}
+	s.cur.Store(cfg)
+	s.mtime.Store(mt)
+	return s, nil
+}
+
+func (s *Store) Path() string { return s.path }
+
+// SetOverride 设置每次加载后应用的覆盖（如环境变量、不允许运行时变更的项），立即作用于当前配置
+func (s *Store) SetOverride(fn func(*Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.override = fn
+	c := *s.cur.Load()
+	fn(&c)
+	s.cur.Store(&c)
+}
+
+// Get 返回当前配置；文件变化时重新加载，失败则沿用旧配置
+func (s *Store) Get() *Config {
+	fi, err := os.Stat(s.path)
+	if err == nil && s.mtime.Load() == fi.ModTime().UnixNano() {
+		return s.cur.Load()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 双检
+	if fi2, err2 := os.Stat(s.path); err2 == nil && s.mtime.Load() == fi2.ModTime().UnixNano() {
+		return s.cur.Load()
+	}
+
+	cfg, mt, err := Load(s.path)
+	if err != nil {
+		log.Printf("[StreamProxy] 读取配置失败，沿用旧配置: %v", err)
+		return s.cur.Load()
+	}
+	if s.override != nil {
+		s.override(cfg)
+	}
+	s.cur.Store(cfg)
+	s.mtime.Store(mt)
+	log.Printf("[StreamProxy] 配置已热加载：users=%d, channels=%d", len(cfg.Users), len(cfg.Channels))
+	return cfg
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"cmp"
+	"net"
+	"strings"
+	"sync"
+)
+
+// 租户：独立的上游、用户、频道与并发上限；按 Host 或 URL 前缀匹配。
+// 未匹配任何租户的请求使用顶层配置（默认租户）
+type TenantCfg struct {
+	Prefix           string                `json:"prefix,omitempty"` // 如 "/acme"：/acme/stream -> /stream
+	Hosts            []string              `json:"hosts,omitempty"`  // 按 Host 头匹配（忽略端口）
+	StreamHost       string                `json:"stream_host"`      // 为空时沿用顶层 stream_host
+	StreamHostHeader string                `json:"stream_host_header,omitempty"`
+	StreamSNI        string                `json:"stream_sni,omitempty"`
+	Users            map[string]UserCfg    `json:"users"`
+	Groups           map[string]GroupCfg   `json:"groups,omitempty"`
+	Channels         map[string]ChannelCfg `json:"channels,omitempty"`
+	UserPolicies     map[string]PolicyCfg  `json:"user_policies,omitempty"` // 租户用户的策略，不继承顶层同名用户
+	MaxSessions      int                   `json:"max_sessions,omitempty"`  // 租户并发流上限，0 = 不限
+}
+
+// 租户视图缓存：首次使用时生成（此时环境变量覆盖已生效）
+type tenantViews struct {
+	mu sync.Mutex
+	m  map[string]*Config
+}
+
+func (c *Config) normalizeTenants() {
+	for name, t := range c.Tenants {
+		if t.Prefix != "" {
+			t.Prefix = "/" + strings.Trim(t.Prefix, "/")
+		}
+		if t.Users == nil {
+			t.Users = map[string]UserCfg{}
+		}
+		for i, h := range t.Hosts {
+			t.Hosts[i] = strings.ToLower(h)
+		}
+		c.Tenants[name] = t
+	}
+	c.tenantViews = &tenantViews{m: map[string]*Config{}}
+}
+
+// TenantName 返回租户视图所属租户；顶层配置返回空串
+func (c *Config) TenantName() string {
+	return c.tenant
+}
+
+// Tenant 返回租户视图：顶层配置的副本，其上游、用户、用户组、用户策略与频道替换为租户自己的。
+// 租户不存在时返回 nil
+func (c *Config) Tenant(name string) *Config {
+	t, ok := c.Tenants[name]
+	if !ok || c.tenantViews == nil {
+		return nil
+	}
+	c.tenantViews.mu.Lock()
+	defer c.tenantViews.mu.Unlock()
+	if v, ok := c.tenantViews.m[name]; ok {
+		return v
+	}
+	v := *c
+	v.tenant = name
+	v.Tenants, v.tenantViews = nil, nil
+	if t.StreamHost != "" {
+		// 上游不同，顶层的 Host/SNI 覆盖不再适用
+		v.StreamHost, v.StreamHostHeader, v.StreamSNI = t.StreamHost, "", ""
+	}
+	v.StreamHostHeader = cmp.Or(t.StreamHostHeader, v.StreamHostHeader)
+	v.StreamSNI = cmp.Or(t.StreamSNI, v.StreamSNI)
+	v.Users, v.Groups, v.Channels, v.UserPolicies = t.Users, t.Groups, t.Channels, t.UserPolicies
+	c.tenantViews.m[name] = &v
+	return &v
+}
+
+// MatchTenant 按 Host 优先、其次最长 URL 前缀匹配租户；prefix 为需剥离的路径前缀
+func (c *Config) MatchTenant(host, path string) (name, prefix string) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for n, t := range c.Tenants {
+		for _, h := range t.Hosts {
+			if h == host {
+				return n, ""
+			}
+		}
+	}
+	for n, t := range c.Tenants {
+		if t.Prefix == "" || len(t.Prefix) <= len(prefix) {
+			continue
+		}
+		if path == t.Prefix || strings.HasPrefix(path, t.Prefix+"/") {
+			name, prefix = n, t.Prefix
+		}
+	}
+	return name, prefix
+}
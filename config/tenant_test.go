@@ -0,0 +1,27 @@
+package config
+
+import "testing"
+
+func TestTenantUserPoliciesIsolated(t *testing.T) {
+	c := &Config{
+		UserPolicies: map[string]PolicyCfg{"alice": {QuotaGB: 1, ABRProfile: "sd"}},
+		Tenants: map[string]TenantCfg{
+			"acme": {Users: map[string]UserCfg{"alice": {Password: "x"}, "bob": {Password: "y"}},
+				UserPolicies: map[string]PolicyCfg{"bob": {QuotaGB: 2}}},
+		},
+	}
+	c.Normalize()
+	if got := c.QuotaFor("alice"); got != 1<<30 {
+		t.Fatalf("top-level QuotaFor(alice) = %d", got)
+	}
+	v := c.Tenant("acme")
+	if got := v.QuotaFor("alice"); got != 0 {
+		t.Errorf("tenant alice inherits top-level quota: %d", got)
+	}
+	if got := v.UserPolicies["alice"].ABRProfile; got != "" {
+		t.Errorf("tenant alice inherits top-level abr_profile %q", got)
+	}
+	if got := v.QuotaFor("bob"); got != 2<<30 {
+		t.Errorf("tenant QuotaFor(bob) = %d", got)
+	}
+}
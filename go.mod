@@ -1,3 +1,5 @@
 module r9mc.com/stream-proxy
 
 go 1.23
+
+require github.com/yuin/gopher-lua v1.1.2
@@ -0,0 +1,250 @@
+// Package history 持久化已结束的会话记录：按天切分的 JSONL 文件 + 保留期清理 + 条件查询。
+//
+// 没有使用嵌入式数据库：项目只依赖标准库，而记录只追加、按天整体过期、查询按时间倒序扫描，
+// 按天的追加文件即可满足，且可以直接用 grep/jq 查看或导入其它系统生成报表。
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	filePrefix = "sessions-"
+	fileSuffix = ".jsonl"
+	dayLayout  = "2006-01-02"
+)
+
+// Record 一个已结束的会话
+type Record struct {
+	UID        string    `json:"uid"` // 全局唯一，写入时生成
+	ID         uint64    `json:"id"`  // 会话 ID，进程内递增，重启后从 1 开始
+	Tenant     string    `json:"tenant,omitempty"`
+	User       string    `json:"user"`
+	IP         string    `json:"ip"`
+	Channel    string    `json:"channel,omitempty"`
+	Path       string    `json:"path"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	DurationMS int64     `json:"duration_ms"`
+	Bytes      int64     `json:"bytes"`
+	Result     string    `json:"result"` // ok / idle / kicked / removed / shutdown / too_slow / upstream_error / upstream_<状态码> / error
+}
+
+// Filter 查询条件；零值字段不参与过滤
+type Filter struct {
+	Tenant  string
+	User    string
+	Channel string
+	IP      string
+	Result  string
+	Since   time.Time // 按会话结束时间
+	Until   time.Time
+	Limit   int // 默认 100，最多 10000
+}
+
+func (f Filter) match(r *Record) bool {
+	return (f.Tenant == "" || r.Tenant == f.Tenant) &&
+		(f.User == "" || r.User == f.User) &&
+		(f.Channel == "" || r.Channel == f.Channel) &&
+		(f.IP == "" || r.IP == f.IP) &&
+		(f.Result == "" || r.Result == f.Result) &&
+		(f.Since.IsZero() || !r.End.Before(f.Since)) &&
+		(f.Until.IsZero() || r.End.Before(f.Until))
+}
+
+// Store 追加写入当天文件；跨天时切换文件并清理过期文件
+type Store struct {
+	dir       string
+	retention time.Duration
+
+	mu  sync.Mutex
+	day string
+	f   *os.File
+}
+
+// Open 打开（必要时创建）历史目录；retentionDays <= 0 时保留 30 天
+func Open(dir string, retentionDays int) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if retentionDays <= 0 {
+		retentionDays = 30
+	}
+	s := &Store{dir: dir, retention: time.Duration(retentionDays) * 24 * time.Hour}
+	s.prune(time.Now())
+	return s, nil
+}
+
+// Dir 返回历史目录
+func (s *Store) Dir() string { return s.dir }
+
+func newUID(end time.Time) string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return end.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// Append 追加一条记录；UID 为空时生成
+func (s *Store) Append(r Record) error {
+	if r.UID == "" {
+		r.UID = newUID(r.End)
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	day := r.End.UTC().Format(dayLayout)
+	if s.f == nil || day != s.day {
+		if s.f != nil {
+			s.f.Close()
+			s.prune(r.End)
+		}
+		f, err := os.OpenFile(filepath.Join(s.dir, filePrefix+day+fileSuffix), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			s.f = nil
+			return err
+		}
+		s.f, s.day = f, day
+	}
+	_, err = s.f.Write(b)
+	return err
+}
+
+// Close 关闭当前文件
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// 删除超过保留期的文件
+func (s *Store) prune(now time.Time) {
+	cutoff := now.Add(-s.retention).UTC().Format(dayLayout)
+	days, err := s.days()
+	if err != nil {
+		log.Printf("[StreamProxy] 历史目录读取失败: %v", err)
+		return
+	}
+	for _, d := range days {
+		if d < cutoff {
+			if err := os.Remove(filepath.Join(s.dir, filePrefix+d+fileSuffix)); err == nil {
+				log.Printf("[StreamProxy] 已清理过期会话历史: %s", d)
+			}
+		}
+	}
+}
+
+// 目录中已有的日期，升序
+func (s *Store) days() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		d := strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileSuffix)
+		if _, err := time.Parse(dayLayout, d); err == nil {
+			out = append(out, d)
+		}
+	}
+	slices.Sort(out)
+	return out, nil
+}
+
+// Query 按条件查询，结果按结束时间倒序
+func (s *Store) Query(f Filter) ([]Record, error) {
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+	f.Limit = min(f.Limit, 10000)
+	days, err := s.days()
+	if err != nil {
+		return nil, err
+	}
+	var out []Record
+	// 从最新的文件往前读，凑够 limit 即停
+	for _, d := range slices.Backward(days) {
+		if !f.Since.IsZero() && d < f.Since.UTC().Format(dayLayout) {
+			break
+		}
+		if !f.Until.IsZero() && d > f.Until.UTC().Format(dayLayout) {
+			continue
+		}
+		recs, err := s.readDay(d, f)
+		if err != nil {
+			return nil, err
+		}
+		slices.Reverse(recs)
+		out = append(out, recs...)
+		if len(out) >= f.Limit {
+			break
+		}
+	}
+	slices.SortStableFunc(out, func(a, b Record) int { return b.End.Compare(a.End) })
+	if len(out) > f.Limit {
+		out = out[:f.Limit]
+	}
+	return out, nil
+}
+
+// 不持有写锁读取，查询不阻塞 Append：每行由一次 Write 追加，读到末尾不完整的一行即停止
+func (s *Store) readDay(day string, f Filter) ([]Record, error) {
+	file, err := os.Open(filepath.Join(s.dir, filePrefix+day+fileSuffix))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var out []Record
+	br := bufio.NewReaderSize(file, 64<<10)
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", day, err)
+		}
+		var r Record
+		if err := json.Unmarshal(bytes.TrimSpace(b), &r); err != nil {
+			// 崩溃时可能留下半行，跳过
+			log.Printf("[StreamProxy] 历史记录损坏，已跳过: %s:%d", day, line)
+			continue
+		}
+		if r.UID == "" {
+			// 旧版本写入的记录没有 UID，以文件与行号代替
+			r.UID = fmt.Sprintf("%s-L%d", day, line)
+		}
+		if f.match(&r) {
+			out = append(out, r)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// stream-proxy migrate：把旧版配置文件升级到当前 schema 并写回，原文件备份为 .v<旧版本>.bak
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	path := fs.String("config", configPath, "配置文件路径")
+	dryRun := fs.Bool("n", false, "只输出升级后的配置，不写回")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	b, err := os.ReadFile(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	out, from, err := config.Migrate(b)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %s: %v\n", *path, err)
+		return 1
+	}
+	if from == config.CurrentVersion {
+		fmt.Printf("%s 已是 v%d，无需升级\n", *path, from)
+		return 0
+	}
+	out = append(out, '\n')
+	if *dryRun {
+		os.Stdout.Write(out)
+		return 0
+	}
+	mode := os.FileMode(0o644)
+	if fi, err := os.Stat(*path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	bak := fmt.Sprintf("%s.v%d.bak", *path, from)
+	if err := os.WriteFile(bak, b, mode); err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: 备份失败: %v\n", err)
+		return 1
+	}
+	tmp := *path + ".tmp"
+	if err := os.WriteFile(tmp, out, mode); err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	if err := os.Rename(tmp, *path); err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s 已从 v%d 升级到 v%d，原文件备份为 %s\n", *path, from, config.CurrentVersion, bak)
+	return 0
+}
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// 清单整体读入内存过滤，超过该大小视为异常
+const maxManifestSize = 4 << 20
+
+// 变体索引保留时间：主播放列表刷新时续期
+const variantTTL = 10 * time.Minute
+
+type variant struct {
+	bandwidth int
+	height    int
+}
+
+// 变体索引：记录主播放列表中各变体的码率/分辨率，用于拦截绕过主播放列表直接请求高档位变体
+type variantIndex struct {
+	mu sync.Mutex
+	m  map[string]variantEntry // 上游 URL（不含查询参数）
+}
+
+type variantEntry struct {
+	variant
+	expires time.Time
+}
+
+func newVariantIndex() *variantIndex {
+	return &variantIndex{m: map[string]variantEntry{}}
+}
+
+func (x *variantIndex) put(u string, v variant) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	now := time.Now()
+	if len(x.m) >= 4096 {
+		for k, e := range x.m {
+			if now.After(e.expires) {
+				delete(x.m, k)
+			}
+		}
+	}
+	x.m[u] = variantEntry{variant: v, expires: now.Add(variantTTL)}
+}
+
+func (x *variantIndex) lookup(u string) (variant, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	e, ok := x.m[stripQuery(u)]
+	if !ok || time.Now().After(e.expires) {
+		return variant{}, false
+	}
+	return e.variant, true
+}
+
+func stripQuery(u string) string {
+	if i := strings.IndexByte(u, '?'); i >= 0 {
+		return u[:i]
+	}
+	return u
+}
+
+// 按用户档位过滤清单；主播放列表中的变体同时写入索引
+func (p *Proxy) applyABR(cfg *config.Config, user, targetURL, path, contentType string, body []byte) []byte {
+	prof, limited := cfg.ABRProfileFor(user)
+	switch {
+	case isPlaylist(path, contentType) && bytes.Contains(body, []byte("#EXT-X-STREAM-INF")):
+		base, _ := url.Parse(targetURL)
+		return filterHLSMaster(body, prof, limited, func(uri string, v variant) {
+			if base == nil {
+				return
+			}
+			if ref, err := base.Parse(uri); err == nil {
+				p.variants.put(stripQuery(ref.String()), v)
+			}
+		})
+	case limited && isDASH(path, contentType):
+		return filterDASH(body, prof)
+	}
+	return body
+}
+
+// 读入整个清单并过滤，替换为内存中的 Body
+func (p *Proxy) filterManifest(cfg *config.Config, user, targetURL, path, contentType string, body io.ReadCloser) (io.ReadCloser, int, error) {
+	b, err := io.ReadAll(io.LimitReader(body, maxManifestSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	b = p.applyABR(cfg, user, targetURL, path, contentType, b)
+	return struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(b), body}, len(b), nil
+}
+
+type hlsVariant struct {
+	variant
+	lines  []string // #EXT-X-STREAM-INF 行（及其后的标签行）与 URI 行
+	iframe bool     // #EXT-X-I-FRAME-STREAM-INF，URI 在属性中
+}
+
+// 过滤 HLS 主播放列表：去掉档位不允许的 #EXT-X-STREAM-INF / #EXT-X-I-FRAME-STREAM-INF；
+// 全部不允许时保留码率最低的一个，避免返回空列表
+func filterHLSMaster(body []byte, prof config.ABRProfileCfg, limited bool, index func(uri string, v variant)) []byte {
+	lines := strings.Split(string(body), "\n")
+	type item struct {
+		line string
+		v    *hlsVariant
+	}
+	var (
+		items []item
+		cur   *hlsVariant
+		all   []*hlsVariant
+	)
+	for _, raw := range lines {
+		line := strings.TrimRight(raw, "\r")
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			cur = &hlsVariant{variant: parseVariantAttrs(line[len("#EXT-X-STREAM-INF:"):]), lines: []string{raw}}
+			all = append(all, cur)
+			items = append(items, item{v: cur})
+		case strings.HasPrefix(line, "#EXT-X-I-FRAME-STREAM-INF:"):
+			attrs := line[len("#EXT-X-I-FRAME-STREAM-INF:"):]
+			v := &hlsVariant{variant: parseVariantAttrs(attrs), lines: []string{raw}, iframe: true}
+			if uri := attrValue(attrs, "URI"); uri != "" {
+				index(uri, v.variant)
+			}
+			items = append(items, item{v: v})
+		case cur != nil:
+			cur.lines = append(cur.lines, raw)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				index(line, cur.variant)
+				cur = nil
+			}
+		default:
+			items = append(items, item{line: raw})
+		}
+	}
+	if !limited {
+		return body
+	}
+
+	keep := map[*hlsVariant]bool{}
+	for _, v := range all {
+		if prof.Allows(v.bandwidth, v.height) {
+			keep[v] = true
+		}
+	}
+	if len(keep) == 0 && len(all) > 0 {
+		keep[slices.MinFunc(all, func(a, b *hlsVariant) int { return a.bandwidth - b.bandwidth })] = true
+	}
+	var out []string
+	for _, it := range items {
+		switch {
+		case it.v == nil:
+			out = append(out, it.line)
+		case it.v.iframe && prof.Allows(it.v.bandwidth, it.v.height), keep[it.v]:
+			out = append(out, it.v.lines...)
+		}
+	}
+	return []byte(strings.Join(out, "\n"))
+}
+
+func parseVariantAttrs(attrs string) variant {
+	var v variant
+	v.bandwidth, _ = strconv.Atoi(attrValue(attrs, "BANDWIDTH"))
+	if res := attrValue(attrs, "RESOLUTION"); res != "" {
+		if _, h, ok := strings.Cut(res, "x"); ok {
+			v.height, _ = strconv.Atoi(h)
+		}
+	}
+	return v
+}
+
+// 取 HLS 属性列表中的值；引号内的逗号不作分隔
+func attrValue(attrs, name string) string {
+	for len(attrs) > 0 {
+		key, rest, ok := strings.Cut(attrs, "=")
+		if !ok {
+			return ""
+		}
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return ""
+			}
+			val, rest = rest[1:end+1], rest[end+2:]
+			rest = strings.TrimPrefix(rest, ",")
+		} else {
+			val, rest, _ = strings.Cut(rest, ",")
+		}
+		if strings.TrimSpace(key) == name {
+			return val
+		}
+		attrs = rest
+	}
+	return ""
+}
+
+var (
+	dashAdaptationSet  = regexp.MustCompile(`(?s)<AdaptationSet\b.*?</AdaptationSet>`)
+	dashRepresentation = regexp.MustCompile(`(?s)<Representation\b[^>]*?(?:/>|>.*?</Representation>)`)
+	dashBandwidth      = regexp.MustCompile(`\bbandwidth="(\d+)"`)
+	dashHeight         = regexp.MustCompile(`\bheight="(\d+)"`)
+)
+
+// 过滤 DASH MPD：每个 AdaptationSet 内去掉档位不允许的 Representation，全部不允许时保留码率最低的一个
+func filterDASH(body []byte, prof config.ABRProfileCfg) []byte {
+	return dashAdaptationSet.ReplaceAllFunc(body, func(set []byte) []byte {
+		reps := dashRepresentation.FindAll(set, -1)
+		if len(reps) == 0 {
+			return set
+		}
+		drop := map[int]bool{}
+		lowest, lowestBW := 0, -1
+		for i, rep := range reps {
+			open := rep
+			if end := bytes.IndexByte(rep, '>'); end >= 0 {
+				open = rep[:end]
+			}
+			bw := dashAttrInt(dashBandwidth, open)
+			if lowestBW < 0 || bw < lowestBW {
+				lowest, lowestBW = i, bw
+			}
+			if !prof.Allows(bw, dashAttrInt(dashHeight, open)) {
+				drop[i] = true
+			}
+		}
+		if len(drop) == len(reps) {
+			delete(drop, lowest)
+		}
+		i := -1
+		return dashRepresentation.ReplaceAllFunc(set, func(rep []byte) []byte {
+			i++
+			if drop[i] {
+				return nil
+			}
+			return rep
+		})
+	})
+}
+
+func dashAttrInt(re *regexp.Regexp, s []byte) int {
+	m := re.FindSubmatch(s)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(string(m[1]))
+	return n
+}
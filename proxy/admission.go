@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// 上限随配置热加载变化，因此用计数 + 广播唤醒而非固定容量的信号量
+type admission struct {
+	mu      sync.Mutex
+	active  int
+	waiting int
+	wake    chan struct{} // release 时关闭并替换，唤醒所有排队者
+}
+
+func newAdmission() *admission {
+	return &admission{wake: make(chan struct{})}
+}
+
+func (a *admission) acquire(ctx context.Context, ac config.AdmissionCfg) bool {
+	a.mu.Lock()
+	if ac.MaxStreams <= 0 || a.active < ac.MaxStreams {
+		a.active++
+		a.mu.Unlock()
+		return true
+	}
+	if ac.QueueTimeoutMS <= 0 || a.waiting >= ac.QueueSize {
+		a.mu.Unlock()
+		return false
+	}
+	a.waiting++
+	defer func() {
+		a.mu.Lock()
+		a.waiting--
+		a.mu.Unlock()
+	}()
+	timer := time.NewTimer(time.Duration(ac.QueueTimeoutMS) * time.Millisecond)
+	defer timer.Stop()
+	for {
+		wake := a.wake
+		a.mu.Unlock()
+		select {
+		case <-wake:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+		a.mu.Lock()
+		if a.active < ac.MaxStreams {
+			a.active++
+			a.mu.Unlock()
+			return true
+		}
+	}
+}
+
+func (a *admission) release() {
+	a.mu.Lock()
+	a.active--
+	close(a.wake)
+	a.wake = make(chan struct{})
+	a.mu.Unlock()
+}
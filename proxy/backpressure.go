@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+var errClientTooSlow = errors.New("client too slow")
+
+const (
+	relayChunk   = 32 << 10
+	maxSkipBytes = 8 << 20 // 超过该量仍未找到关键帧时，从下一个 TS 包边界恢复
+)
+
+// 读写解耦：上游读取在当前 goroutine，客户端写入在独立 goroutine，
+// 队列写满超过 StallMS 即按策略处理
+func relayWithBackpressure(ctx context.Context, w *flushWriter, body io.ReadCloser, bp config.BackpressureCfg, downgrade func() (io.ReadCloser, error)) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	queue := make(chan []byte, max(4, bp.BufferKB*1024/relayChunk))
+	done := make(chan error, 1)
+	go func() {
+		var werr error
+		for b := range queue {
+			if werr != nil {
+				continue
+			}
+			if _, err := w.Write(b); err != nil {
+				werr = err
+				cancel(err)
+			}
+		}
+		done <- werr
+	}()
+
+	err := pumpUpstream(ctx, body, queue, bp, downgrade)
+	if errors.Is(err, errClientTooSlow) {
+		// 让阻塞中的 Write 立即返回，避免 handler 返回后仍在写
+		_ = w.rc.SetWriteDeadline(time.Now())
+	}
+	close(queue)
+	werr := <-done
+	if err == nil {
+		err = werr
+	}
+	return err
+}
+
+func pumpUpstream(ctx context.Context, body io.ReadCloser, queue chan []byte, bp config.BackpressureCfg, downgrade func() (io.ReadCloser, error)) error {
+	defer func() { body.Close() }()
+	stall := time.Duration(bp.StallMS) * time.Millisecond
+	timer := time.NewTimer(stall)
+	defer timer.Stop()
+
+	var (
+		skipping   bool
+		skipped    int
+		downgraded bool
+	)
+	for {
+		buf := make([]byte, relayChunk)
+		n, err := body.Read(buf)
+		if n > 0 {
+			chunk := buf[:n]
+			if skipping {
+				off := tsKeyframeOffset(chunk)
+				if off < 0 && skipped+n > maxSkipBytes {
+					off = tsSyncOffset(chunk)
+				}
+				if off < 0 {
+					skipped += n
+					chunk = nil
+				} else {
+					chunk, skipping = chunk[off:], false
+				}
+			}
+			if chunk != nil && !enqueue(ctx, queue, chunk, timer, stall) {
+				if ctx.Err() != nil {
+					return context.Cause(ctx)
+				}
+				switch bp.Policy {
+				case config.BackpressureDisconnect:
+					return errClientTooSlow
+				case config.BackpressureDowngrade:
+					if downgrade != nil && !downgraded {
+						if nb, derr := downgrade(); derr != nil {
+							log.Printf("[StreamProxy] 降档失败，改为跳帧: %v", derr)
+						} else {
+							body.Close()
+							body, downgraded = nb, true
+							log.Printf("[StreamProxy] 客户端拥塞，已切换到低码率上游")
+						}
+					}
+				}
+				// downgrade / skip：丢弃积压，从关键帧续播
+				drain(queue)
+				skipping, skipped = true, 0
+				continue
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// 在 stall 时限内入队；失败返回 false
+func enqueue(ctx context.Context, queue chan []byte, b []byte, timer *time.Timer, stall time.Duration) bool {
+	select {
+	case queue <- b:
+		return true
+	default:
+	}
+	timer.Reset(stall)
+	defer timer.Stop()
+	select {
+	case queue <- b:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func drain(queue chan []byte) {
+	for {
+		select {
+		case <-queue:
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+var errTooLarge = errors.New("response too large to cache")
+
+// 缓存条目：仅缓存 200 响应
+type cacheEntry struct {
+	header  http.Header
+	body    []byte
+	fetched time.Time
+}
+
+type cacheCall struct {
+	done  chan struct{}
+	entry *cacheEntry
+	err   error
+}
+
+// 小响应缓存（播放列表、EPG 片段、频道列表），同一 URL 的并发未命中只回源一次
+type responseCache struct {
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	inflight map[string]*cacheCall
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: map[string]*cacheEntry{}, inflight: map[string]*cacheCall{}}
+}
+
+func cacheable(cc config.CacheCfg, path string) bool {
+	if !cc.Enabled {
+		return false
+	}
+	p := strings.ToLower(path)
+	if i := strings.IndexByte(p, '?'); i >= 0 {
+		p = p[:i]
+	}
+	for _, s := range cc.Suffixes {
+		if strings.HasSuffix(p, strings.ToLower(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// get 返回 key 对应的响应：新鲜直接返回；过期但在 stale 窗口内返回旧值并后台刷新；否则同步回源。
+// 第二个返回值为 HIT / STALE / MISS
+func (c *responseCache) get(key string, cc config.CacheCfg, fetch func() (*cacheEntry, error)) (*cacheEntry, string, error) {
+	ttl := time.Duration(cc.TTLMS) * time.Millisecond
+	stale := time.Duration(cc.StaleMS) * time.Millisecond
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		age := time.Since(e.fetched)
+		if age < ttl {
+			c.mu.Unlock()
+			return e, "HIT", nil
+		}
+		if age < ttl+stale {
+			if _, busy := c.inflight[key]; !busy {
+				c.startLocked(key, cc, fetch)
+			}
+			c.mu.Unlock()
+			return e, "STALE", nil
+		}
+	}
+	call, busy := c.inflight[key]
+	if !busy {
+		call = c.startLocked(key, cc, fetch)
+	}
+	c.mu.Unlock()
+
+	<-call.done
+	return call.entry, "MISS", call.err
+}
+
+func (c *responseCache) startLocked(key string, cc config.CacheCfg, fetch func() (*cacheEntry, error)) *cacheCall {
+	call := &cacheCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	go func() {
+		e, err := fetch()
+		c.mu.Lock()
+		delete(c.inflight, key)
+		if err == nil {
+			c.entries[key] = e
+			c.evictLocked(cc)
+		}
+		c.mu.Unlock()
+		call.entry, call.err = e, err
+		close(call.done)
+	}()
+	return call
+}
+
+// 超出 MaxEntries 时先清理完全过期的条目，仍超出则淘汰最旧的
+func (c *responseCache) evictLocked(cc config.CacheCfg) {
+	if len(c.entries) <= cc.MaxEntries {
+		return
+	}
+	limit := time.Duration(cc.TTLMS+cc.StaleMS) * time.Millisecond
+	var oldestKey string
+	var oldest time.Time
+	for k, e := range c.entries {
+		if time.Since(e.fetched) >= limit {
+			delete(c.entries, k)
+			continue
+		}
+		if oldestKey == "" || e.fetched.Before(oldest) {
+			oldestKey, oldest = k, e.fetched
+		}
+	}
+	if len(c.entries) > cc.MaxEntries && oldestKey != "" {
+		delete(c.entries, oldestKey)
+	}
+}
+
+// 缓存键：最终上游地址、实际发出的 Host 与 SNI，以及透传或脚本设置的全部请求头，
+// 任一不同都视为不同的响应
+func cacheKey(cfg *config.Config, req *http.Request) string {
+	host, sni := req.URL.Host, ""
+	if sameOrigin(req.URL, cfg.StreamHost) {
+		host, sni = cmp.Or(cfg.StreamHostHeader, host), cfg.StreamSNI
+	}
+	var b strings.Builder
+	b.WriteString(req.URL.String() + "\x00" + host + "\x00" + sni)
+	for _, k := range slices.Sorted(maps.Keys(req.Header)) {
+		b.WriteString("\x00" + k + ": " + strings.Join(req.Header[k], ", "))
+	}
+	return b.String()
+}
+
+// 回源并完整读取；使用脱离客户端的 context，避免首个请求方断开导致其他等待者一起失败
+func (p *Proxy) fetchSmall(upReq, client *http.Request, cc config.CacheCfg) (*cacheEntry, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(client.Context()), 15*time.Second)
+	defer cancel()
+	cfg := p.config(client.Context())
+	if cfg == nil {
+		return nil, errTenantRemoved
+	}
+	req := upReq.Clone(ctx)
+	p.logForward(req, client)
+	resp, err := p.upstreamDo(cfg, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{code: resp.StatusCode}
+	}
+	limit := int64(cc.MaxEntryKB) << 10
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errTooLarge
+	}
+	return &cacheEntry{header: resp.Header.Clone(), body: body, fetched: time.Now()}, nil
+}
+
+type statusError struct{ code int }
+
+func (e *statusError) Error() string { return "upstream status " + strconv.Itoa(e.code) }
+
+// 尝试从缓存响应；返回 false 表示应走常规转发（未启用、过大或上游非 200）
+func (p *Proxy) serveCached(w http.ResponseWriter, r *http.Request, cfg *config.Config, path string) bool {
+	if !cacheable(cfg.Cache, path) {
+		return false
+	}
+	targetURL := upstreamURL(cfg, path, r)
+	req, err := p.buildUpstreamRequest(r.Context(), targetURL, r)
+	if err != nil {
+		return false
+	}
+	e, state, err := p.cache.get(cacheKey(cfg, req), cfg.Cache, func() (*cacheEntry, error) {
+		return p.fetchSmall(req, r, cfg.Cache)
+	})
+	if err != nil {
+		var se *statusError
+		if !errors.Is(err, errTooLarge) && !errors.As(err, &se) {
+			log.Printf("[StreamProxy] 缓存回源失败: %s: %v", req.URL, err)
+		}
+		return false
+	}
+	copyHeaders(w.Header(), e.header, cfg.ResponseHeaders.Forward)
+	ct := e.header.Get("Content-Type")
+	if isPlaylist(path, ct) {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	} else if ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	var user string
+	if id, ok := identityFrom(r.Context()); ok {
+		user = id.user
+	}
+	body := p.applyABR(cfg, user, targetURL, path, ct, e.body)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("X-Cache", state)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	return true
+}
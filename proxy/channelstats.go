@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 未对应任何已配置频道的按 path 播放，统计时归入此项（避免任意路径撑大指标基数）
+const otherChannel = "_other"
+
+// 按频道统计观看：实时人数、峰值（进程启动以来）、累计会话数与观看时长
+type channelStats struct {
+	mu sync.Mutex
+	m  map[[2]string]*ChannelStat
+}
+
+// ChannelStat 单个频道的观看统计
+type ChannelStat struct {
+	Tenant       string    `json:"tenant,omitempty"`
+	Channel      string    `json:"channel"`
+	Viewers      int       `json:"viewers"`
+	Peak         int       `json:"peak"`
+	PeakAt       time.Time `json:"peak_at"`
+	Sessions     int64     `json:"sessions"`
+	WatchSeconds int64     `json:"watch_seconds"`
+
+	watch time.Duration // 已结束会话的累计时长
+}
+
+func newChannelStats() *channelStats {
+	return &channelStats{m: map[[2]string]*ChannelStat{}}
+}
+
+func (c *channelStats) join(s *session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := [2]string{s.tenant, s.statsChannel}
+	st := c.m[k]
+	if st == nil {
+		st = &ChannelStat{Tenant: s.tenant, Channel: s.statsChannel}
+		c.m[k] = st
+	}
+	st.Viewers++
+	st.Sessions++
+	if st.Viewers > st.Peak {
+		st.Peak, st.PeakAt = st.Viewers, time.Now()
+	}
+}
+
+func (c *channelStats) leave(s *session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st := c.m[[2]string{s.tenant, s.statsChannel}]; st != nil {
+		st.Viewers--
+		st.watch += time.Since(s.start)
+	}
+}
+
+// ChannelStats 返回全部频道的统计，按当前人数、峰值降序
+func (p *Proxy) ChannelStats() []ChannelStat {
+	p.channelStats.mu.Lock()
+	out := make([]ChannelStat, 0, len(p.channelStats.m))
+	for _, st := range p.channelStats.m {
+		c := *st
+		c.WatchSeconds = int64(c.watch.Seconds())
+		out = append(out, c)
+	}
+	p.channelStats.mu.Unlock()
+	slices.SortFunc(out, func(a, b ChannelStat) int {
+		return cmp.Or(cmp.Compare(b.Viewers, a.Viewers), cmp.Compare(b.Peak, a.Peak),
+			cmp.Compare(a.Tenant, b.Tenant), cmp.Compare(a.Channel, b.Channel))
+	})
+	return out
+}
@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// 集群命令
+const (
+	clusterKick       = "kick"
+	clusterQuotaReset = "quota_reset"
+)
+
+// 节点间交换的状态：本节点的活跃会话数与流量用量（仅本节点产生的部分）
+type clusterState struct {
+	Node     string           `json:"node"`
+	Sessions map[string]int   `json:"sessions"` // 租户 -> 会话数，顶层为 ""
+	Period   time.Time        `json:"period"`
+	Usage    map[string]int64 `json:"usage,omitempty"` // 键为 租户/用户名
+}
+
+type clusterCommand struct {
+	Op   string `json:"op"`
+	User string `json:"user"`
+}
+
+// ClusterPeer 对端状态，供管理接口查看
+type ClusterPeer struct {
+	URL      string    `json:"url"`
+	Node     string    `json:"node,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+	Sessions int       `json:"sessions"`
+	Self     bool      `json:"self,omitempty"` // 对端就是本节点
+	Error    string    `json:"error,omitempty"`
+}
+
+// ClusterInfo 集群状态
+type ClusterInfo struct {
+	Node  string        `json:"node"`
+	Peers []ClusterPeer `json:"peers"`
+}
+
+type clusterNode struct {
+	state clusterState
+	seen  time.Time
+}
+
+type cluster struct {
+	mu     sync.Mutex
+	nodes  map[string]*clusterNode // 节点名 -> 最近一次状态
+	links  map[string]*ClusterPeer // 对端地址 -> 连接状态
+	client *http.Client
+}
+
+func newCluster() *cluster {
+	return &cluster{
+		nodes:  map[string]*clusterNode{},
+		links:  map[string]*ClusterPeer{},
+		client: &http.Client{Timeout: 3 * time.Second},
+	}
+}
+
+func nodeName(cc config.ClusterCfg) string {
+	if cc.Node != "" {
+		return cc.Node
+	}
+	h, _ := os.Hostname()
+	return cmp.Or(h, "node")
+}
+
+func (p *Proxy) localClusterState(cc config.ClusterCfg) clusterState {
+	st := clusterState{Node: nodeName(cc), Sessions: map[string]int{}}
+	for _, s := range p.sessions.list() {
+		st.Sessions[s.tenant]++
+	}
+	qs := p.quota.snapshot()
+	st.Period, st.Usage = qs.Period, qs.Usage
+	return st
+}
+
+// 合并对端状态；自身（同一份配置中把自己也列为 peer）忽略
+func (p *Proxy) mergeClusterState(cc config.ClusterCfg, st clusterState) {
+	if st.Node == "" || st.Node == nodeName(cc) {
+		return
+	}
+	p.cluster.mu.Lock()
+	p.cluster.nodes[st.Node] = &clusterNode{state: st, seen: time.Now()}
+	p.cluster.mu.Unlock()
+	p.refreshRemoteQuota(cc)
+}
+
+// 超过 3 个周期未更新的节点视为离线
+func (c *cluster) fresh(cc config.ClusterCfg) []clusterState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []clusterState
+	for name, n := range c.nodes {
+		if time.Since(n.seen) > 3*cc.Interval() {
+			delete(c.nodes, name)
+			continue
+		}
+		out = append(out, n.state)
+	}
+	return out
+}
+
+// 其它节点上该租户的活跃会话数
+func (p *Proxy) remoteSessions(tenant string) int {
+	cc := p.src.Get().Cluster
+	if len(cc.Peers) == 0 {
+		return 0
+	}
+	n := 0
+	for _, st := range p.cluster.fresh(cc) {
+		n += st.Sessions[tenant]
+	}
+	return n
+}
+
+// 汇总其它节点同一计费周期的流量
+func (p *Proxy) refreshRemoteQuota(cc config.ClusterCfg) {
+	period := p.quota.snapshot().Period
+	sums := map[string]int64{}
+	for _, st := range p.cluster.fresh(cc) {
+		if !st.Period.Equal(period) {
+			continue
+		}
+		for k, v := range st.Usage {
+			sums[k] += v
+		}
+	}
+	p.quota.setRemote(sums)
+}
+
+// 定时与所有对端交换状态（推送本节点状态，响应中带回对端状态）
+func (p *Proxy) clusterLoop(ctx context.Context) {
+	for {
+		cc := p.src.Get().Cluster
+		interval := cc.Interval()
+		if len(cc.Peers) > 0 {
+			p.gossip(ctx, cc)
+			p.refreshRemoteQuota(cc)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (p *Proxy) gossip(ctx context.Context, cc config.ClusterCfg) {
+	body, _ := json.Marshal(p.localClusterState(cc))
+	var wg sync.WaitGroup
+	for _, peer := range cc.Peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var st clusterState
+			err := p.clusterPost(ctx, cc, peer, "/cluster/gossip", body, &st)
+			p.cluster.mu.Lock()
+			link := p.cluster.links[peer]
+			if link == nil {
+				link = &ClusterPeer{URL: peer}
+				p.cluster.links[peer] = link
+			}
+			if err != nil {
+				if link.Error == "" {
+					log.Printf("[StreamProxy] 集群节点不可达: %s: %v", peer, err)
+				}
+				link.Error = err.Error()
+			} else {
+				link.Self = st.Node == nodeName(cc)
+				if !link.Self && (link.Error != "" || link.LastSeen.IsZero()) {
+					log.Printf("[StreamProxy] 集群节点已连接: %s (%s)", peer, st.Node)
+				}
+				link.Node, link.LastSeen, link.Error = st.Node, time.Now(), ""
+			}
+			p.cluster.mu.Unlock()
+			if err == nil {
+				p.mergeClusterState(cc, st)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Proxy) clusterPost(ctx context.Context, cc config.ClusterCfg, peer, path string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(peer, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cluster-Secret", cc.Secret)
+	resp, err := p.cluster.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ClusterGossip 处理对端推送的状态，返回本节点状态
+func (p *Proxy) ClusterGossip(r *http.Request) (any, error) {
+	cc := p.src.Get().Cluster
+	var st clusterState
+	if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+		return nil, err
+	}
+	p.mergeClusterState(cc, st)
+	return p.localClusterState(cc), nil
+}
+
+// ClusterCommand 执行对端转发的命令（仅在本节点执行，不再转发）
+func (p *Proxy) ClusterCommand(r *http.Request) (any, error) {
+	var cmd clusterCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		return nil, err
+	}
+	switch cmd.Op {
+	case clusterKick:
+		return map[string]int{"count": p.Kick(0, cmd.User)}, nil
+	case clusterQuotaReset:
+		n := 0
+		if p.quota.reset(cmd.User) {
+			n = 1
+		}
+		return map[string]int{"count": n}, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", cmd.Op)
+}
+
+// 把命令发给所有对端，返回各节点处理的数量之和
+func (p *Proxy) broadcast(ctx context.Context, cmd clusterCommand) int {
+	cc := p.src.Get().Cluster
+	body, _ := json.Marshal(cmd)
+	var (
+		mu    sync.Mutex
+		total int
+		wg    sync.WaitGroup
+	)
+	for _, peer := range cc.Peers {
+		p.cluster.mu.Lock()
+		link := p.cluster.links[peer]
+		p.cluster.mu.Unlock()
+		if link != nil && link.Self {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out struct {
+				Count int `json:"count"`
+			}
+			if err := p.clusterPost(ctx, cc, peer, "/cluster/command", body, &out); err != nil {
+				log.Printf("[StreamProxy] 集群命令 %s 发送失败: %s: %v", cmd.Op, peer, err)
+				return
+			}
+			mu.Lock()
+			total += out.Count
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return total
+}
+
+// KickUser 断开该用户在所有节点上的会话，返回断开总数
+func (p *Proxy) KickUser(ctx context.Context, user string) int {
+	return p.Kick(0, user) + p.broadcast(ctx, clusterCommand{Op: clusterKick, User: user})
+}
+
+// ClusterInfo 返回本节点名与各对端状态
+func (p *Proxy) ClusterInfo() ClusterInfo {
+	cc := p.src.Get().Cluster
+	info := ClusterInfo{Node: nodeName(cc), Peers: []ClusterPeer{}}
+	sessions := map[string]int{}
+	for _, st := range p.cluster.fresh(cc) {
+		for _, n := range st.Sessions {
+			sessions[st.Node] += n
+		}
+	}
+	p.cluster.mu.Lock()
+	defer p.cluster.mu.Unlock()
+	for _, peer := range cc.Peers {
+		pi := ClusterPeer{URL: peer}
+		if link := p.cluster.links[peer]; link != nil {
+			pi = *link
+		}
+		pi.Sessions = sessions[pi.Node]
+		info.Peers = append(info.Peers, pi)
+	}
+	slices.SortFunc(info.Peers, func(a, b ClusterPeer) int { return strings.Compare(a.URL, b.URL) })
+	return info
+}
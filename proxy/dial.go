@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+var errBlockedUpstream = errors.New("upstream address not allowed")
+
+// 按 upstream.address_family 连接上游；配置热加载后对新连接生效
+func (p *Proxy) dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	cfg := p.src.Get()
+	uc := cfg.Upstream
+	d := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 60 * time.Second, FallbackDelay: uc.FallbackDelay()}
+	if cfg.SSRF.Enabled && !cfg.TrustedUpstream(addr) {
+		// 在 connect 前按解析出的实际 IP 校验，DNS 重绑定也无法绕过
+		d.ControlContext = func(_ context.Context, _, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil || cfg.BlockedUpstreamIP(ap.Addr()) {
+				log.Printf("[StreamProxy] 拒绝连接内部地址: %s (%s)", addr, address)
+				return fmt.Errorf("%w: %s", errBlockedUpstream, address)
+			}
+			return nil
+		}
+	}
+	switch uc.AddressFamily {
+	case "ipv4":
+		return d.DialContext(ctx, "tcp4", addr)
+	case "ipv6":
+		return d.DialContext(ctx, "tcp6", addr)
+	case "prefer_ipv4":
+		return happyEyeballs(ctx, d, "tcp4", "tcp6", addr)
+	case "prefer_ipv6":
+		return happyEyeballs(ctx, d, "tcp6", "tcp4", addr)
+	}
+	// auto：net.Dialer 自带 Happy Eyeballs（RFC 6555），按系统地址排序选首选地址族
+	return d.DialContext(ctx, network, addr)
+}
+
+// 先用 primary 连接，超过 FallbackDelay 未成功或已失败时并行尝试 fallback，取先成功者
+func happyEyeballs(ctx context.Context, d *net.Dialer, primary, fallback, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c       net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result, 2)
+	dial := func(network string, primary bool) {
+		c, err := d.DialContext(ctx, network, addr)
+		results <- result{c, err, primary}
+	}
+	go dial(primary, true)
+	pending, started := 1, false
+	startFallback := func() {
+		if !started {
+			started = true
+			pending++
+			go dial(fallback, false)
+		}
+	}
+
+	var timer <-chan time.Time
+	if d.FallbackDelay >= 0 {
+		t := time.NewTimer(d.FallbackDelay)
+		defer t.Stop()
+		timer = t.C
+	}
+	var firstErr error
+	for {
+		select {
+		case <-timer:
+			startFallback()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// 另一路随后若也连上则关闭
+				if pending > 0 {
+					go func() {
+						if r := <-results; r.c != nil {
+							r.c.Close()
+						}
+					}()
+				}
+				return r.c, nil
+			}
+			if firstErr == nil || r.primary {
+				firstErr = r.err
+			}
+			startFallback()
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
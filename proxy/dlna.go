@@ -0,0 +1,355 @@
+package proxy
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"r9mc.com/stream-proxy/auth"
+	"r9mc.com/stream-proxy/config"
+)
+
+// UPnP 设备与服务类型
+const (
+	dlnaDeviceType = "urn:schemas-upnp-org:device:MediaServer:1"
+	dlnaCDS        = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	dlnaCMS        = "urn:schemas-upnp-org:service:ConnectionManager:1"
+)
+
+// 未配置 dlna.uuid 时由主机名与端口生成，重启后保持不变
+func dlnaUUID(cfg *config.Config) string {
+	if cfg.DLNA.UUID != "" {
+		return strings.TrimPrefix(cfg.DLNA.UUID, "uuid:")
+	}
+	host, _ := os.Hostname()
+	h := sha1.Sum([]byte("stream-proxy\x00" + host + "\x00" + strconv.Itoa(cfg.Listen.Port)))
+	h[6] = h[6]&0x0f | 0x50
+	h[8] = h[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// 未配置 dlna.token 时使用的随机令牌，重启后失效
+func newDLNAToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (p *Proxy) dlnaToken(cfg *config.Config) string {
+	return cmp.Or(cfg.DLNA.Token, p.dlnaSecret)
+}
+
+// dlnaTokenAuth 校验 DLNA 播放地址中的 dlna_token：仅限顶层配置、按 channel 播放且来自局域网或 dlna.allow
+func (p *Proxy) dlnaTokenAuth(cfg *config.Config, r *http.Request, ip, token string) bool {
+	q := r.URL.Query()
+	return cfg.DLNA.Enabled && cfg.DLNA.User != "" && cfg.TenantName() == "" &&
+		r.Pattern == "/stream" && q.Get("channel") != "" && q.Get("path") == "" &&
+		cfg.DLNAAllowed(ip) &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(p.dlnaToken(cfg))) == 1
+}
+
+// /dlna/ 下的设备描述、服务描述与 SOAP 控制；不经过中间件链，只应答局域网或 dlna.allow 中的来源
+func (p *Proxy) dlnaHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := p.src.Get()
+	if !cfg.DLNA.Enabled || !cfg.DLNAAllowed(auth.ClientIP(r, cfg.TrustedProxyPrefixes())) {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.URL.Path {
+	case "/dlna/device.xml":
+		writeXML(w, dlnaDeviceXML(cfg, p.build.Version))
+	case "/dlna/cds.xml":
+		writeXML(w, cdsSCPD)
+	case "/dlna/cms.xml":
+		writeXML(w, cmsSCPD)
+	case "/dlna/control/cds":
+		p.cdsControl(w, r, cfg)
+	case "/dlna/control/cms":
+		cmsControl(w, r)
+	case "/dlna/event/cds", "/dlna/event/cms":
+		// 不推送事件，只应答订阅，避免部分电视反复重试
+		switch r.Method {
+		case "SUBSCRIBE":
+			w.Header().Set("SID", "uuid:"+dlnaUUID(cfg)+"-"+strings.TrimPrefix(r.URL.Path, "/dlna/event/"))
+			w.Header().Set("TIMEOUT", "Second-1800")
+		case "UNSUBSCRIBE":
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeXML(w http.ResponseWriter, s string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	io.WriteString(w, s)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func dlnaDeviceXML(cfg *config.Config, version string) string {
+	return `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>` + dlnaDeviceType + `</deviceType>
+<friendlyName>` + xmlEscape(cfg.DLNA.Name()) + `</friendlyName>
+<manufacturer>stream-proxy</manufacturer>
+<modelName>stream-proxy</modelName>
+<modelNumber>` + xmlEscape(version) + `</modelNumber>
+<UDN>uuid:` + dlnaUUID(cfg) + `</UDN>
+<dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC>
+<serviceList>
+<service><serviceType>` + dlnaCDS + `</serviceType><serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+<SCPDURL>/dlna/cds.xml</SCPDURL><controlURL>/dlna/control/cds</controlURL><eventSubURL>/dlna/event/cds</eventSubURL></service>
+<service><serviceType>` + dlnaCMS + `</serviceType><serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+<SCPDURL>/dlna/cms.xml</SCPDURL><controlURL>/dlna/control/cms</controlURL><eventSubURL>/dlna/event/cms</eventSubURL></service>
+</serviceList>
+</device>
+</root>
+`
+}
+
+// SOAP 请求：Body 下唯一的动作元素，参数按名称取值
+type soapAction struct {
+	Name string
+	Args map[string]string
+}
+
+func readSOAP(r *http.Request) (soapAction, error) {
+	a := soapAction{Args: map[string]string{}}
+	if r.Method != http.MethodPost {
+		return a, fmt.Errorf("method %s", r.Method)
+	}
+	var env struct {
+		Body struct {
+			Action struct {
+				XMLName xml.Name
+				Args    []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&env); err != nil {
+		return a, err
+	}
+	a.Name = env.Body.Action.XMLName.Local
+	for _, arg := range env.Body.Action.Args {
+		a.Args[arg.XMLName.Local] = arg.Value
+	}
+	return a, nil
+}
+
+// 输出 SOAP 响应；args 为按顺序的 名称, 值 对
+func writeSOAP(w http.ResponseWriter, service, action string, args ...string) {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	b.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&b, `<u:%sResponse xmlns:u="%s">`, action, service)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, "<%s>%s</%s>", args[i], xmlEscape(args[i+1]), args[i])
+	}
+	fmt.Fprintf(&b, `</u:%sResponse></s:Body></s:Envelope>`, action)
+	w.Header().Set("EXT", "")
+	writeXML(w, b.String())
+}
+
+// UPnP 错误：401 Invalid Action，402 Invalid Args，701 No such object
+func writeSOAPFault(w http.ResponseWriter, code int, desc string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault>
+<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+<errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code, xmlEscape(desc))
+}
+
+const dlnaItemPrefix = "ch/"
+
+// ContentDirectory：根容器 "0" 下每个频道一个视频条目
+func (p *Proxy) cdsControl(w http.ResponseWriter, r *http.Request, cfg *config.Config) {
+	a, err := readSOAP(r)
+	if err != nil {
+		writeSOAPFault(w, 401, "Invalid Action")
+		return
+	}
+	user, token := cfg.DLNA.User, p.dlnaToken(cfg)
+	var names []string
+	if user != "" {
+		names, _ = watchableChannels(cfg, user, "")
+	}
+	updateID := strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(strings.Join(names, "\x00")))), 10)
+
+	switch a.Name {
+	case "GetSearchCapabilities":
+		writeSOAP(w, dlnaCDS, a.Name, "SearchCaps", "")
+	case "GetSortCapabilities":
+		writeSOAP(w, dlnaCDS, a.Name, "SortCaps", "")
+	case "GetSystemUpdateID":
+		writeSOAP(w, dlnaCDS, a.Name, "Id", updateID)
+	case "Browse":
+		start, _ := strconv.Atoi(a.Args["StartingIndex"])
+		count, _ := strconv.Atoi(a.Args["RequestedCount"])
+		id := a.Args["ObjectID"]
+		base := dlnaStreamBase(r)
+		var didl []string
+		total := 0
+		switch {
+		case a.Args["BrowseFlag"] == "BrowseMetadata" && id == "0":
+			didl = append(didl, fmt.Sprintf(`<container id="0" parentID="-1" restricted="1" searchable="0" childCount="%d"><dc:title>%s</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`,
+				len(names), xmlEscape(cfg.DLNA.Name())))
+			total = 1
+		case a.Args["BrowseFlag"] == "BrowseMetadata" && strings.HasPrefix(id, dlnaItemPrefix):
+			name := strings.TrimPrefix(id, dlnaItemPrefix)
+			ch, ok := cfg.Channels[name]
+			if !ok || !slices.Contains(names, name) {
+				writeSOAPFault(w, 701, "No such object")
+				return
+			}
+			didl = append(didl, dlnaItem(base, name, ch, token))
+			total = 1
+		case a.Args["BrowseFlag"] == "BrowseDirectChildren" && id == "0":
+			total = len(names)
+			page := names[min(max(start, 0), len(names)):]
+			if count > 0 {
+				page = page[:min(count, len(page))]
+			}
+			for _, name := range page {
+				didl = append(didl, dlnaItem(base, name, cfg.Channels[name], token))
+			}
+		case a.Args["BrowseFlag"] == "BrowseDirectChildren" && strings.HasPrefix(id, dlnaItemPrefix) &&
+			slices.Contains(names, strings.TrimPrefix(id, dlnaItemPrefix)):
+			// 条目没有子节点
+		case a.Args["BrowseFlag"] != "BrowseMetadata" && a.Args["BrowseFlag"] != "BrowseDirectChildren":
+			writeSOAPFault(w, 402, "Invalid Args")
+			return
+		default:
+			writeSOAPFault(w, 701, "No such object")
+			return
+		}
+		result := `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">` +
+			strings.Join(didl, "") + `</DIDL-Lite>`
+		writeSOAP(w, dlnaCDS, a.Name, "Result", result, "NumberReturned", strconv.Itoa(len(didl)),
+			"TotalMatches", strconv.Itoa(total), "UpdateID", updateID)
+	default:
+		writeSOAPFault(w, 401, "Invalid Action")
+	}
+}
+
+// 播放地址使用电视访问本服务时的 Host，保证可达
+func dlnaStreamBase(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/stream"
+}
+
+// 播放地址携带 dlna_token 而不是用户密码
+func dlnaItem(base, name string, ch config.ChannelCfg, token string) string {
+	mime := "video/mp2t"
+	if strings.HasSuffix(strings.ToLower(ch.Path), ".m3u8") {
+		mime = "application/vnd.apple.mpegurl"
+	}
+	v := url.Values{"channel": {name}, "dlna_token": {token}}
+	return fmt.Sprintf(`<item id="%s" parentID="0" restricted="1"><dc:title>%s</dc:title><upnp:class>object.item.videoItem.videoBroadcast</upnp:class><res protocolInfo="http-get:*:%s:*">%s</res></item>`,
+		xmlEscape(dlnaItemPrefix+name), xmlEscape(name), mime, xmlEscape(base+"?"+v.Encode()))
+}
+
+// ConnectionManager：只作为源，不维护连接
+func cmsControl(w http.ResponseWriter, r *http.Request) {
+	a, err := readSOAP(r)
+	if err != nil {
+		writeSOAPFault(w, 401, "Invalid Action")
+		return
+	}
+	switch a.Name {
+	case "GetProtocolInfo":
+		writeSOAP(w, dlnaCMS, a.Name, "Source", "http-get:*:video/mp2t:*,http-get:*:application/vnd.apple.mpegurl:*", "Sink", "")
+	case "GetCurrentConnectionIDs":
+		writeSOAP(w, dlnaCMS, a.Name, "ConnectionIDs", "0")
+	case "GetCurrentConnectionInfo":
+		writeSOAP(w, dlnaCMS, a.Name, "RcsID", "-1", "AVTransportID", "-1", "ProtocolInfo", "",
+			"PeerConnectionManager", "", "PeerConnectionID", "-1", "Direction", "Output", "Status", "OK")
+	default:
+		writeSOAPFault(w, 401, "Invalid Action")
+	}
+}
+
+func scpdArg(name, dir, v string) string {
+	return "<argument><name>" + name + "</name><direction>" + dir + "</direction><relatedStateVariable>" + v + "</relatedStateVariable></argument>"
+}
+
+func scpdAction(name string, args ...string) string {
+	return "<action><name>" + name + "</name><argumentList>" + strings.Join(args, "") + "</argumentList></action>\n"
+}
+
+func scpdVar(name, typ string, allowed ...string) string {
+	s := `<stateVariable sendEvents="no"><name>` + name + "</name><dataType>" + typ + "</dataType>"
+	if len(allowed) > 0 {
+		s += "<allowedValueList><allowedValue>" + strings.Join(allowed, "</allowedValue><allowedValue>") + "</allowedValue></allowedValueList>"
+	}
+	return s + "</stateVariable>\n"
+}
+
+func scpd(actions, vars string) string {
+	return `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0"><specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+` + actions + `</actionList>
+<serviceStateTable>
+` + vars + `</serviceStateTable>
+</scpd>
+`
+}
+
+var cdsSCPD = scpd(
+	scpdAction("GetSearchCapabilities", scpdArg("SearchCaps", "out", "SearchCapabilities"))+
+		scpdAction("GetSortCapabilities", scpdArg("SortCaps", "out", "SortCapabilities"))+
+		scpdAction("GetSystemUpdateID", scpdArg("Id", "out", "SystemUpdateID"))+
+		scpdAction("Browse",
+			scpdArg("ObjectID", "in", "A_ARG_TYPE_ObjectID"), scpdArg("BrowseFlag", "in", "A_ARG_TYPE_BrowseFlag"),
+			scpdArg("Filter", "in", "A_ARG_TYPE_Filter"), scpdArg("StartingIndex", "in", "A_ARG_TYPE_Index"),
+			scpdArg("RequestedCount", "in", "A_ARG_TYPE_Count"), scpdArg("SortCriteria", "in", "A_ARG_TYPE_SortCriteria"),
+			scpdArg("Result", "out", "A_ARG_TYPE_Result"), scpdArg("NumberReturned", "out", "A_ARG_TYPE_Count"),
+			scpdArg("TotalMatches", "out", "A_ARG_TYPE_Count"), scpdArg("UpdateID", "out", "A_ARG_TYPE_UpdateID")),
+	scpdVar("SearchCapabilities", "string")+scpdVar("SortCapabilities", "string")+
+		scpdVar("SystemUpdateID", "ui4")+scpdVar("A_ARG_TYPE_ObjectID", "string")+
+		scpdVar("A_ARG_TYPE_BrowseFlag", "string", "BrowseMetadata", "BrowseDirectChildren")+
+		scpdVar("A_ARG_TYPE_Filter", "string")+scpdVar("A_ARG_TYPE_Index", "ui4")+scpdVar("A_ARG_TYPE_Count", "ui4")+
+		scpdVar("A_ARG_TYPE_SortCriteria", "string")+scpdVar("A_ARG_TYPE_Result", "string")+scpdVar("A_ARG_TYPE_UpdateID", "ui4"),
+)
+
+var cmsSCPD = scpd(
+	scpdAction("GetProtocolInfo", scpdArg("Source", "out", "SourceProtocolInfo"), scpdArg("Sink", "out", "SinkProtocolInfo"))+
+		scpdAction("GetCurrentConnectionIDs", scpdArg("ConnectionIDs", "out", "CurrentConnectionIDs"))+
+		scpdAction("GetCurrentConnectionInfo",
+			scpdArg("ConnectionID", "in", "A_ARG_TYPE_ConnectionID"), scpdArg("RcsID", "out", "A_ARG_TYPE_RcsID"),
+			scpdArg("AVTransportID", "out", "A_ARG_TYPE_AVTransportID"), scpdArg("ProtocolInfo", "out", "A_ARG_TYPE_ProtocolInfo"),
+			scpdArg("PeerConnectionManager", "out", "A_ARG_TYPE_ConnectionManager"), scpdArg("PeerConnectionID", "out", "A_ARG_TYPE_ConnectionID"),
+			scpdArg("Direction", "out", "A_ARG_TYPE_Direction"), scpdArg("Status", "out", "A_ARG_TYPE_ConnectionStatus")),
+	scpdVar("SourceProtocolInfo", "string")+scpdVar("SinkProtocolInfo", "string")+scpdVar("CurrentConnectionIDs", "string")+
+		scpdVar("A_ARG_TYPE_ConnectionStatus", "string", "OK", "ContentFormatMismatch", "InsufficientBandwidth", "UnreliableChannel", "Unknown")+
+		scpdVar("A_ARG_TYPE_ConnectionManager", "string")+scpdVar("A_ARG_TYPE_Direction", "string", "Input", "Output")+
+		scpdVar("A_ARG_TYPE_ProtocolInfo", "string")+scpdVar("A_ARG_TYPE_ConnectionID", "i4")+
+		scpdVar("A_ARG_TYPE_AVTransportID", "i4")+scpdVar("A_ARG_TYPE_RcsID", "i4"),
+)
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+var errUpstreamStalled = errors.New("upstream stalled")
+
+// 上游故障时改为循环输出 slate，后台按 retry 间隔重连，恢复后从关键帧切回上游。
+// 客户端连接不中断，只有客户端断开或会话被取消时才结束
+type fallbackReader struct {
+	ctx   context.Context
+	fc    config.FallbackCfg
+	open  func(context.Context) (io.ReadCloser, error)
+	label string // 日志用
+
+	up      io.ReadCloser // 当前上游；nil 表示正在输出 slate
+	syncing bool          // 刚恢复：丢弃数据直到关键帧
+	skipped int
+
+	slate     io.ReadCloser
+	recovered chan io.ReadCloser
+	dialing   bool
+	nextDial  time.Time
+	onSwitch  func()
+}
+
+// upErr 非 nil 表示首次连接上游即失败，直接从 slate 开始
+func newFallbackReader(ctx context.Context, up io.ReadCloser, upErr error, fc config.FallbackCfg, open func(context.Context) (io.ReadCloser, error), label string, onSwitch func()) *fallbackReader {
+	f := &fallbackReader{ctx: ctx, fc: fc, open: open, label: label, up: up, recovered: make(chan io.ReadCloser, 1), onSwitch: onSwitch}
+	if upErr != nil {
+		up.Close()
+		f.up = nil
+		f.toSlate(upErr)
+	}
+	return f
+}
+
+func (f *fallbackReader) Read(b []byte) (int, error) {
+	for {
+		if err := f.ctx.Err(); err != nil {
+			return 0, context.Cause(f.ctx)
+		}
+		if f.up == nil {
+			select {
+			case nb := <-f.recovered:
+				f.dialing = false
+				if nb != nil {
+					f.up, f.syncing, f.skipped = nb, true, 0
+					log.Printf("[StreamProxy] 上游已恢复，切回直播: %s", f.label)
+					continue
+				}
+				f.nextDial = time.Now().Add(f.fc.Retry())
+			default:
+			}
+			if !f.dialing && !time.Now().Before(f.nextDial) {
+				f.dial()
+			}
+			n, err := f.slate.Read(b)
+			if err != nil && n == 0 {
+				// slate 只会因 ctx 结束而报错
+				return 0, err
+			}
+			return n, nil
+		}
+
+		n, err := f.readUpstream(b)
+		if n > 0 && f.syncing {
+			off := tsKeyframeOffset(b[:n])
+			if off < 0 && f.skipped+n > maxSkipBytes {
+				off = tsSyncOffset(b[:n])
+			}
+			if off < 0 {
+				f.skipped += n
+				n = 0
+			} else {
+				n = copy(b, b[off:n])
+				f.syncing = false
+			}
+		}
+		if err != nil {
+			if f.ctx.Err() != nil {
+				return n, context.Cause(f.ctx)
+			}
+			f.up.Close()
+			f.up = nil
+			f.toSlate(err)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// 单次读取超过 stall 时限视为上游卡死，关闭上游使 Read 返回
+func (f *fallbackReader) readUpstream(b []byte) (int, error) {
+	up := f.up
+	var stalled atomic.Bool
+	t := time.AfterFunc(f.fc.Stall(), func() {
+		stalled.Store(true)
+		up.Close()
+	})
+	n, err := up.Read(b)
+	if !t.Stop() && stalled.Load() {
+		return n, errUpstreamStalled
+	}
+	return n, err
+}
+
+func (f *fallbackReader) toSlate(cause error) {
+	log.Printf("[StreamProxy] 上游故障，切换到备用画面: %s: %v", f.label, cause)
+	if f.onSwitch != nil {
+		f.onSwitch()
+	}
+	if f.slate == nil {
+		f.slate = newPacedReader(f.ctx, io.NopCloser(newLoopReader(f.fc.Slate)), config.PacingCfg{Source: true, MaxKbps: f.fc.Kbps()})
+	}
+	f.nextDial = time.Now().Add(f.fc.Retry())
+}
+
+// 后台重连，结果通过 recovered 送回；失败送回 nil
+func (f *fallbackReader) dial() {
+	f.dialing = true
+	go func() {
+		// 连接与响应头超时由 HTTP 客户端限制
+		nb, err := f.open(f.ctx)
+		if err != nil {
+			nb = nil
+		}
+		f.recovered <- nb
+	}()
+}
+
+func (f *fallbackReader) Close() error {
+	if f.up != nil {
+		f.up.Close()
+		f.up = nil
+	}
+	if f.dialing {
+		f.dialing = false
+		// 等待进行中的重连结束，关闭其结果
+		go func() {
+			if nb := <-f.recovered; nb != nil {
+				nb.Close()
+			}
+		}()
+	}
+	return nil
+}
+
+// 循环读取 slate 文件（按 TS 包对齐，读取失败时输出空包）
+type loopReader struct {
+	data []byte
+	pos  int
+}
+
+func newLoopReader(path string) *loopReader {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("[StreamProxy] 读取备用画面失败: %v", err)
+	}
+	data = data[:min(len(data), maxSlateSize)/tsPacketSize*tsPacketSize]
+	if len(data) == 0 {
+		data = nullPacket()
+	}
+	return &loopReader{data: data}
+}
+
+func (l *loopReader) Read(b []byte) (int, error) {
+	n := copy(b, l.data[l.pos:])
+	l.pos = (l.pos + n) % len(l.data)
+	return n, nil
+}
+
+// PID 0x1FFF 的空包
+func nullPacket() []byte {
+	pkt := make([]byte, tsPacketSize)
+	pkt[0], pkt[1], pkt[2], pkt[3] = 0x47, 0x1f, 0xff, 0x10
+	for i := 4; i < len(pkt); i++ {
+		pkt[i] = 0xff
+	}
+	return pkt
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+func isPlaylist(path, contentType string) bool {
+	ct := strings.ToLower(contentType)
+	if strings.Contains(ct, "mpegurl") {
+		return true
+	}
+	p := strings.ToLower(path)
+	if i := strings.IndexByte(p, '?'); i >= 0 {
+		p = p[:i]
+	}
+	return strings.HasSuffix(p, ".m3u8") || strings.HasSuffix(p, ".m3u")
+}
+
+// DASH 清单
+func isDASH(path, contentType string) bool {
+	if strings.Contains(strings.ToLower(contentType), "dash+xml") {
+		return true
+	}
+	p := strings.ToLower(path)
+	if i := strings.IndexByte(p, '?'); i >= 0 {
+		p = p[:i]
+	}
+	return strings.HasSuffix(p, ".mpd")
+}
+
+type flushWriter struct {
+	mu       sync.Mutex
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	always   bool // 播放列表：每次写入后立即 Flush
+	bytes    int
+	interval time.Duration
+	pending  int
+	timer    *time.Timer
+	failed   bool // 向客户端写入或 Flush 失败过
+}
+
+func newFlushWriter(w http.ResponseWriter, fc config.FlushCfg, always bool) *flushWriter {
+	return &flushWriter{
+		w:        w,
+		rc:       http.NewResponseController(w),
+		always:   always,
+		bytes:    fc.Bytes,
+		interval: time.Duration(fc.IntervalMS) * time.Millisecond,
+	}
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.w.Write(p)
+	f.pending += n
+	if err != nil {
+		f.failed = true
+		return n, err
+	}
+	switch {
+	case f.always || (f.bytes > 0 && f.pending >= f.bytes):
+		err = f.flushLocked()
+	case f.interval > 0 && f.timer == nil:
+		f.timer = time.AfterFunc(f.interval, f.onTimer)
+	}
+	return n, err
+}
+
+// clientFailed 报告是否因客户端一侧写入失败而中断
+func (f *flushWriter) clientFailed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failed
+}
+
+func (f *flushWriter) onTimer() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.timer = nil
+	if f.pending > 0 {
+		_ = f.flushLocked()
+	}
+}
+
+func (f *flushWriter) flushLocked() error {
+	f.pending = 0
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	if err := f.rc.Flush(); err != nil {
+		f.failed = true
+		return err
+	}
+	return nil
+}
+
+// handler 返回前调用，停止定时器，避免在 ResponseWriter 失效后 Flush
+func (f *flushWriter) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	f.pending = 0
+	f.interval = 0
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// 按压缩级别复用 gzip.Writer（每个约占数百 KB）
+var gzipPools [gzip.BestCompression + 1]sync.Pool
+
+// 可压缩的文本类型；TS 等媒体数据永不压缩
+func compressible(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	if strings.HasPrefix(ct, "video/") || strings.HasPrefix(ct, "audio/") && !strings.Contains(ct, "mpegurl") {
+		return false
+	}
+	for _, t := range []string{"mpegurl", "dash+xml", "xml", "json", "text/"} {
+		if strings.Contains(ct, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, q, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(enc), "gzip") && strings.TrimSpace(q) != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// Compress 对接受 gzip 的客户端压缩文本响应（清单、EPG、JSON 等），由 gzip.clients 开启；
+// 是否压缩在写出响应头时按 Content-Type 决定，流媒体数据原样透传
+func (p *Proxy) Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gc := p.src.Get().Gzip
+		if !gc.Clients || r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, gc: gc}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+type gzipWriter struct {
+	http.ResponseWriter
+	gc      config.GzipCfg
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if !g.decided {
+		g.decided = true
+		h := g.Header()
+		if code == http.StatusOK && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+			h.Add("Vary", "Accept-Encoding")
+			if n, err := strconv.Atoi(h.Get("Content-Length")); err != nil || n >= g.gc.Min() {
+				h.Del("Content-Length")
+				h.Set("Content-Encoding", "gzip")
+				level := g.gc.CompressionLevel()
+				if gz, ok := gzipPools[level].Get().(*gzip.Writer); ok {
+					gz.Reset(g.ResponseWriter)
+					g.gz = gz
+				} else {
+					g.gz, _ = gzip.NewWriterLevel(g.ResponseWriter, level)
+				}
+			}
+		}
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if !g.decided {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// 供 http.ResponseController 使用：先把已压缩的数据推给底层连接
+func (g *gzipWriter) FlushError() error {
+	if g.gz != nil {
+		if err := g.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func (g *gzipWriter) Flush() { g.FlushError() }
+
+func (g *gzipWriter) Unwrap() http.ResponseWriter { return g.ResponseWriter }
+
+func (g *gzipWriter) close() {
+	if g.gz == nil {
+		return
+	}
+	g.gz.Close()
+	g.gz.Reset(io.Discard)
+	gzipPools[g.gc.CompressionLevel()].Put(g.gz)
+	g.gz = nil
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// SetStandby 设置是否为待机节点；待机期间拒绝新的流会话，已有会话不受影响
+func (p *Proxy) SetStandby(on bool) {
+	p.standby.Store(on)
+}
+
+// Standby 是否为待机节点
+func (p *Proxy) Standby() bool {
+	return p.standby.Load()
+}
+
+func (p *Proxy) rejectStandby(w http.ResponseWriter) bool {
+	if !p.standby.Load() {
+		return false
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Standby instance", http.StatusServiceUnavailable)
+	return true
+}
+
+// QuotaState 返回当前计费周期与本节点的流量用量，供主备同步
+func (p *Proxy) QuotaState() (period time.Time, usage map[string]int64) {
+	st := p.quota.snapshot()
+	return st.Period, st.Usage
+}
+
+// MergeQuota 合并对端同一计费周期的用量（取较大值，可重复调用）
+func (p *Proxy) MergeQuota(period time.Time, usage map[string]int64) {
+	p.quota.mu.Lock()
+	same := p.quota.period.Equal(period)
+	p.quota.mu.Unlock()
+	if !same {
+		return
+	}
+	for k, v := range usage {
+		c := p.quota.counter(k)
+		for {
+			cur := c.Load()
+			if cur >= v || c.CompareAndSwap(cur, v) {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// 逐跳头永不透传
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func headerMatch(patterns []string, name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(strings.ToLower(name), strings.ToLower(prefix)) {
+				return true
+			}
+		} else if http.CanonicalHeaderKey(p) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isHopHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, h := range hopHeaders {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 按 patterns 把 src 中匹配的头复制到 dst（覆盖 dst 中同名头），请求/响应两个方向共用
+func copyHeaders(dst, src http.Header, patterns []string) {
+	if len(patterns) == 0 {
+		return
+	}
+	// Connection 中列出的头同样按逐跳处理
+	var connHeaders []string
+	for _, v := range src.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				connHeaders = append(connHeaders, http.CanonicalHeaderKey(f))
+			}
+		}
+	}
+	for name, vals := range src {
+		if isHopHeader(name) || headerMatch(connHeaders, name) || !headerMatch(patterns, name) {
+			continue
+		}
+		dst[name] = append([]string(nil), vals...)
+	}
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+	"r9mc.com/stream-proxy/history"
+)
+
+// 会话结束原因（写入历史与 session_end 插件事件）；试看到时为 preview_ended
+const (
+	resultOK            = "ok"
+	resultIdle          = "idle"
+	resultKicked        = "kicked"
+	resultRemoved       = "removed"
+	resultShutdown      = "shutdown"
+	resultTooSlow       = "too_slow"
+	resultUpstreamError = "upstream_error"
+	resultError         = "error"
+	resultRevoked       = "revoked"
+	resultMaxDuration   = "max_duration"
+)
+
+func causeResult(cause error) string {
+	switch {
+	case errors.Is(cause, errKicked):
+		return resultKicked
+	case errors.Is(cause, errUpstreamRemoved), errors.Is(cause, errTenantRemoved):
+		return resultRemoved
+	case errors.Is(cause, errOutsideSchedule):
+		return resultOutsideSchedule
+	case errors.Is(cause, errQuotaExceeded):
+		return resultQuotaExceeded
+	case errors.Is(cause, errAccessRevoked):
+		return resultRevoked
+	case errors.Is(cause, errMaxDuration):
+		return resultMaxDuration
+	case errors.Is(cause, errShutdown):
+		return resultShutdown
+	case errors.Is(cause, errPreviewEnded):
+		return resultPreviewEnded
+	}
+	return ""
+}
+
+// 按配置中的目录打开历史存储；目录变化时切换
+type historyHolder struct {
+	mu    sync.Mutex
+	store *history.Store
+}
+
+func (h *historyHolder) get(hc config.HistoryCfg) *history.Store {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hc.Dir == "" {
+		return nil
+	}
+	if h.store != nil && h.store.Dir() == hc.Dir {
+		return h.store
+	}
+	s, err := history.Open(hc.Dir, hc.RetentionDays)
+	if err != nil {
+		log.Printf("[StreamProxy] 打开会话历史失败: %v", err)
+		return nil
+	}
+	if h.store != nil {
+		h.store.Close()
+	}
+	h.store = s
+	return s
+}
+
+func (h *historyHolder) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.store != nil {
+		h.store.Close()
+		h.store = nil
+	}
+}
+
+// History 返回会话历史存储；未配置 history.dir 时返回 nil
+func (p *Proxy) History() *history.Store {
+	return p.history.get(p.src.Get().History)
+}
+
+func (s *session) event(hook string) pluginEvent {
+	return pluginEvent{Hook: hook, Tenant: s.tenant, User: s.user, IP: s.ip, Channel: s.channel, Path: s.path, SessionID: s.id}
+}
+
+// 会话结束：写入历史并通知 session_end 插件
+func (p *Proxy) endSession(cfg *config.Config, s *session, result string) {
+	end := time.Now()
+	ev := s.event(hookSessionEnd)
+	ev.Bytes = s.upBytes.Load()
+	ev.DurationMS = end.Sub(s.start).Milliseconds()
+	ev.Reason = result
+	p.pluginNotify(cfg, ev)
+
+	h := p.history.get(cfg.History)
+	if h == nil {
+		return
+	}
+	err := h.Append(history.Record{
+		ID: s.id, Tenant: s.tenant, User: s.user, IP: s.ip, Channel: s.channel, Path: s.path,
+		Start: s.start, End: end, DurationMS: ev.DurationMS, Bytes: ev.Bytes, Result: result,
+	})
+	if err != nil {
+		log.Printf("[StreamProxy] 写入会话历史失败: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// 解析后的 HLS 清单；主清单只有 variants，媒体清单只有分片
+type hlsPlaylist struct {
+	variants []hlsVariantRef
+	init     string   // #EXT-X-MAP（fMP4 初始化段）
+	segments []string // 绝对地址
+	seq      int64    // 第一个分片的序号（#EXT-X-MEDIA-SEQUENCE）
+	target   time.Duration
+	ended    bool // #EXT-X-ENDLIST
+}
+
+type hlsVariantRef struct {
+	uri       string
+	bandwidth int
+}
+
+func parseHLS(b []byte, base *url.URL) *hlsPlaylist {
+	pl := &hlsPlaylist{}
+	var inf *variant
+	for _, raw := range strings.Split(string(b), "\n") {
+		line := strings.TrimSpace(raw)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			v := parseVariantAttrs(line[len("#EXT-X-STREAM-INF:"):])
+			inf = &v
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			if u := attrValue(line[len("#EXT-X-MAP:"):], "URI"); u != "" {
+				pl.init = resolveRef(base, u)
+			}
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			pl.seq, _ = strconv.ParseInt(line[len("#EXT-X-MEDIA-SEQUENCE:"):], 10, 64)
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			sec, _ := strconv.Atoi(line[len("#EXT-X-TARGETDURATION:"):])
+			pl.target = time.Duration(sec) * time.Second
+		case line == "#EXT-X-ENDLIST":
+			pl.ended = true
+		case line == "" || strings.HasPrefix(line, "#"):
+		case inf != nil:
+			pl.variants = append(pl.variants, hlsVariantRef{uri: resolveRef(base, line), bandwidth: inf.bandwidth})
+			inf = nil
+		default:
+			pl.segments = append(pl.segments, resolveRef(base, line))
+		}
+	}
+	return pl
+}
+
+func resolveRef(base *url.URL, ref string) string {
+	u, err := base.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return u.String()
+}
+
+func (p *Proxy) fetchHLS(ctx context.Context, cfg *config.Config, src string) (*hlsPlaylist, error) {
+	base, err := url.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.fetchUpstream(ctx, cfg, src)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	b, err := io.ReadAll(io.LimitReader(body, maxManifestSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseHLS(b, base), nil
+}
+
+// 从 src 找到媒体清单：遇到主清单时由 pick 选择档位
+func (p *Proxy) hlsMedia(ctx context.Context, cfg *config.Config, src string, pick func([]hlsVariantRef) hlsVariantRef) (string, *hlsPlaylist, error) {
+	for range 3 {
+		pl, err := p.fetchHLS(ctx, cfg, src)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(pl.variants) == 0 {
+			return src, pl, nil
+		}
+		src = pick(pl.variants).uri
+	}
+	return "", nil, errors.New("too many nested playlists")
+}
+
+func lowestVariant(vs []hlsVariantRef) hlsVariantRef {
+	best := vs[0]
+	for _, v := range vs[1:] {
+		if v.bandwidth < best.bandwidth {
+			best = v
+		}
+	}
+	return best
+}
+
+func highestVariant(vs []hlsVariantRef) hlsVariantRef {
+	best := vs[0]
+	for _, v := range vs[1:] {
+		if v.bandwidth > best.bandwidth {
+			best = v
+		}
+	}
+	return best
+}
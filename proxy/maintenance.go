@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"cmp"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// MaintenanceInfo 维护模式状态
+type MaintenanceInfo struct {
+	Enabled bool       `json:"enabled"`
+	Since   *time.Time `json:"since,omitempty"`
+	Message string     `json:"message,omitempty"` // 覆盖 maintenance.message
+}
+
+// 维护模式：由管理接口开关，仅拒绝新的流会话，已有会话继续播放直到自然结束
+type maintenance struct {
+	mu   sync.Mutex
+	info MaintenanceInfo
+}
+
+// SetMaintenance 开启或关闭维护模式；message 为空时使用配置中的提示
+func (p *Proxy) SetMaintenance(on bool, message string) MaintenanceInfo {
+	p.maint.mu.Lock()
+	defer p.maint.mu.Unlock()
+	switch {
+	case on && !p.maint.info.Enabled:
+		now := time.Now()
+		p.maint.info = MaintenanceInfo{Enabled: true, Since: &now, Message: message}
+		log.Printf("[StreamProxy] 进入维护模式，活跃会话 %d 个", len(p.sessions.list()))
+	case on:
+		p.maint.info.Message = message
+	case p.maint.info.Enabled:
+		p.maint.info = MaintenanceInfo{}
+		log.Printf("[StreamProxy] 退出维护模式")
+	}
+	return p.maint.info
+}
+
+// Maintenance 返回当前维护模式状态
+func (p *Proxy) Maintenance() MaintenanceInfo {
+	p.maint.mu.Lock()
+	defer p.maint.mu.Unlock()
+	return p.maint.info
+}
+
+// 维护期间拒绝新会话：配置了 slate 时以 200 返回提示画面，否则返回 status + message
+func (p *Proxy) rejectMaintenance(w http.ResponseWriter, cfg *config.Config) bool {
+	info := p.Maintenance()
+	if !info.Enabled {
+		return false
+	}
+	p.metrics.maintenanceRejected.Add(1)
+	mc := cfg.Maintenance
+	if mc.Slate != "" {
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("Cache-Control", "no-store")
+		writeSlate(w, mc.Slate)
+		return true
+	}
+	if mc.RetryAfterSec > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(mc.RetryAfterSec))
+	}
+	http.Error(w, cmp.Or(info.Message, mc.Message, "Service under maintenance"), mc.StatusCode())
+	return true
+}
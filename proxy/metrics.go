@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Prometheus 文本格式指标，仅用标准库
+type metrics struct {
+	sessionsTotal       atomic.Int64
+	idleTeardowns       atomic.Int64
+	upstreamBytes       atomic.Int64
+	admissionRejected   atomic.Int64
+	rateLimited         atomic.Int64
+	sessionsResumed     atomic.Int64
+	transcodeRestarts   atomic.Int64
+	maintenanceRejected atomic.Int64
+	fallbacks           atomic.Int64
+	pluginDropped       atomic.Int64
+	requests            requestCounter
+}
+
+// 按路由与状态码计数
+type requestCounter struct {
+	mu sync.Mutex
+	m  map[[2]string]int64
+}
+
+func (c *requestCounter) inc(route string, code int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = map[[2]string]int64{}
+	}
+	c.m[[2]string{route, strconv.Itoa(code)}]++
+}
+
+func (p *Proxy) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	m := &p.metrics
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b := p.build
+	fmt.Fprintf(w, "# HELP stream_proxy_build_info Build information.\n# TYPE stream_proxy_build_info gauge\nstream_proxy_build_info{version=%q,commit=%q,date=%q,goversion=%q} 1\n",
+		b.Version, b.Commit, b.Date, b.GoVersion)
+	writeMetric(w, "stream_proxy_active_sessions", "gauge", "Currently active stream sessions.", int64(len(p.sessions.list())))
+	writeMetric(w, "stream_proxy_sessions_total", "counter", "Stream sessions started.", m.sessionsTotal.Load())
+	writeMetric(w, "stream_proxy_idle_teardowns_total", "counter", "Sessions torn down because the upstream stopped delivering data.", m.idleTeardowns.Load())
+	writeMetric(w, "stream_proxy_upstream_bytes_total", "counter", "Bytes read from upstream.", m.upstreamBytes.Load())
+	writeMetric(w, "stream_proxy_admission_rejected_total", "counter", "Stream requests rejected by admission control.", m.admissionRejected.Load())
+	writeMetric(w, "stream_proxy_rate_limited_total", "counter", "Requests rejected by the rate limiter.", m.rateLimited.Load())
+	writeMetric(w, "stream_proxy_parked_upstreams", "gauge", "Upstreams kept alive waiting for a client to reconnect.", int64(p.resume.len()))
+	writeMetric(w, "stream_proxy_sessions_resumed_total", "counter", "Sessions that took over a parked upstream.", m.sessionsResumed.Load())
+	writeMetric(w, "stream_proxy_transcoders", "gauge", "Running ffmpeg transcode pipelines.", int64(p.transcoder.len()))
+	writeMetric(w, "stream_proxy_transcode_restarts_total", "counter", "ffmpeg restarts after an unexpected exit.", m.transcodeRestarts.Load())
+
+	writeMetric(w, "stream_proxy_fallback_switches_total", "counter", "Times a stream switched to the fallback slate after an upstream failure.", m.fallbacks.Load())
+	writeMetric(w, "stream_proxy_plugin_dropped_total", "counter", "Plugin runs abandoned while waiting for a max_concurrent slot.", m.pluginDropped.Load())
+	var maint int64
+	if p.Maintenance().Enabled {
+		maint = 1
+	}
+	writeMetric(w, "stream_proxy_maintenance", "gauge", "Whether maintenance mode is enabled.", maint)
+	writeMetric(w, "stream_proxy_maintenance_rejected_total", "counter", "Stream requests rejected during maintenance.", m.maintenanceRejected.Load())
+
+	if probes := p.prober.list(); len(probes) > 0 {
+		fmt.Fprintf(w, "# HELP stream_proxy_channel_up Whether the channel upstream passed the last probe.\n# TYPE stream_proxy_channel_up gauge\n")
+		for _, r := range probes {
+			up := 0
+			if r.OK {
+				up = 1
+			}
+			fmt.Fprintf(w, "stream_proxy_channel_up{tenant=%q,channel=%q} %d\n", r.Tenant, r.Channel, up)
+		}
+	}
+
+	if stats := p.ChannelStats(); len(stats) > 0 {
+		fmt.Fprintf(w, "# HELP stream_proxy_channel_viewers Current viewers per channel.\n# TYPE stream_proxy_channel_viewers gauge\n")
+		for _, st := range stats {
+			fmt.Fprintf(w, "stream_proxy_channel_viewers{tenant=%q,channel=%q} %d\n", st.Tenant, st.Channel, st.Viewers)
+		}
+		fmt.Fprintf(w, "# HELP stream_proxy_channel_viewers_peak Peak concurrent viewers per channel since start.\n# TYPE stream_proxy_channel_viewers_peak gauge\n")
+		for _, st := range stats {
+			fmt.Fprintf(w, "stream_proxy_channel_viewers_peak{tenant=%q,channel=%q} %d\n", st.Tenant, st.Channel, st.Peak)
+		}
+		fmt.Fprintf(w, "# HELP stream_proxy_channel_sessions_total Sessions started per channel.\n# TYPE stream_proxy_channel_sessions_total counter\n")
+		for _, st := range stats {
+			fmt.Fprintf(w, "stream_proxy_channel_sessions_total{tenant=%q,channel=%q} %d\n", st.Tenant, st.Channel, st.Sessions)
+		}
+	}
+
+	m.requests.mu.Lock()
+	keys := make([][2]string, 0, len(m.requests.m))
+	for k := range m.requests.m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b [2]string) int {
+		return cmp.Or(cmp.Compare(a[0], b[0]), cmp.Compare(a[1], b[1]))
+	})
+	fmt.Fprintf(w, "# HELP stream_proxy_http_requests_total HTTP requests by route and status.\n# TYPE stream_proxy_http_requests_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "stream_proxy_http_requests_total{route=%q,code=%q} %d\n", k[0], k[1], m.requests.m[k])
+	}
+	m.requests.mu.Unlock()
+}
+
+func writeMetric(w http.ResponseWriter, name, typ, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, v)
+}
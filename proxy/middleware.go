@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/auth"
+)
+
+// Middleware 横切逻辑；按 routes 配置的顺序组装，排在前面的先执行
+type Middleware func(http.Handler) http.Handler
+
+// 未在 routes 中配置的路由使用的默认链
+var defaultChain = []string{"gzip", "metrics", "auth", "ratelimit", "rewrite"}
+
+// 已认证的请求方，由 auth 中间件写入 context
+type identity struct {
+	user string
+	ip   string
+}
+
+type identityKey struct{}
+
+func identityFrom(ctx context.Context) (identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(identity)
+	return id, ok
+}
+
+// Use 注册自定义中间件，注册后即可在 routes 配置中按名称引用；同名覆盖内置实现
+func (p *Proxy) Use(name string, mw Middleware) {
+	p.mwMu.Lock()
+	defer p.mwMu.Unlock()
+	p.middlewares[name] = mw
+	p.chains = nil
+}
+
+func (p *Proxy) builtinMiddlewares() map[string]Middleware {
+	return map[string]Middleware{
+		"gzip":      p.Compress,
+		"logging":   p.loggingMiddleware,
+		"metrics":   p.metricsMiddleware,
+		"auth":      p.authMiddleware,
+		"ratelimit": p.rateLimitMiddleware,
+		"rewrite":   p.rewriteMiddleware,
+	}
+}
+
+// route 按配置组装中间件链；配置变化后重建
+func (p *Proxy) route(pattern string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.chainFor(pattern, h).ServeHTTP(w, r)
+	})
+}
+
+func (p *Proxy) chainFor(pattern string, h http.Handler) http.Handler {
+	cfg := p.src.Get()
+	p.mwMu.Lock()
+	defer p.mwMu.Unlock()
+	if p.chainsCfg != cfg || p.chains == nil {
+		p.chains, p.chainsCfg = map[string]http.Handler{}, cfg
+	}
+	if c, ok := p.chains[pattern]; ok {
+		return c
+	}
+	names, ok := cfg.Routes[pattern]
+	if !ok {
+		names = defaultChain
+	}
+	c := h
+	for i := len(names) - 1; i >= 0; i-- {
+		mw, ok := p.middlewares[names[i]]
+		if !ok {
+			log.Printf("[StreamProxy] 路由 %s：未知中间件 %q，已忽略", pattern, names[i])
+			continue
+		}
+		c = mw(c)
+	}
+	p.chains[pattern] = c
+	return c
+}
+
+// 记录状态码与写出字节
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// 供 http.ResponseController 找到底层连接（Flush / SetWriteDeadline）
+func (s *statusWriter) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+func wrapStatus(w http.ResponseWriter) *statusWriter {
+	if sw, ok := w.(*statusWriter); ok {
+		return sw
+	}
+	return &statusWriter{ResponseWriter: w}
+}
+
+// logging：请求结束后输出访问日志
+func (p *Proxy) loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := wrapStatus(w)
+		next.ServeHTTP(sw, r)
+		user, _ := auth.Credentials(r)
+		// trusted_proxies 只能在顶层配置，租户视图沿用同一份；取顶层配置使已删除租户的请求也能记录客户端 IP
+		log.Printf("[StreamProxy] %s %s status=%d bytes=%d dur=%s user=%s ip=%s",
+			r.Method, r.URL.Path, sw.status, sw.bytes, time.Since(start).Round(time.Millisecond),
+			user, auth.ClientIP(r, p.src.Get().TrustedProxyPrefixes()))
+	})
+}
+
+// metrics：按路由与状态码计数
+func (p *Proxy) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := wrapStatus(w)
+		next.ServeHTTP(sw, r)
+		p.metrics.requests.inc(r.Pattern, sw.status)
+	})
+}
+
+// auth：校验 user/pass，写入请求方身份
+func (p *Proxy) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := p.config(r.Context())
+		if cfg == nil {
+			http.Error(w, "Unknown tenant", http.StatusNotFound)
+			return
+		}
+		if tok := r.URL.Query().Get("dlna_token"); tok != "" {
+			ip := auth.ClientIP(r, cfg.TrustedProxyPrefixes())
+			if !p.dlnaTokenAuth(cfg, r, ip, tok) {
+				log.Printf("[StreamProxy] DLNA 令牌无效或超出范围: ip=%s path=%s", ip, r.URL.Path)
+				http.Error(w, "Invalid credentials", http.StatusForbidden)
+				return
+			}
+			ctx := context.WithValue(r.Context(), identityKey{}, identity{user: cfg.DLNA.User, ip: ip})
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		user, pass := auth.Credentials(r)
+		if user == "" || pass == "" {
+			http.Error(w, "Missing parameters", http.StatusBadRequest)
+			return
+		}
+		ip := auth.ClientIP(r, cfg.TrustedProxyPrefixes())
+		decided, allow := p.scriptAuth(cfg.Scripts.Auth, scriptData{
+			Tenant: cfg.TenantName(), User: user, Pass: pass, IP: ip, Path: r.URL.Query().Get("path"), Channel: r.URL.Query().Get("channel"),
+			Query: r.URL.Query(), Header: r.Header,
+		})
+		if !decided {
+			allow = auth.Check(cfg, user, pass) || p.pluginAuthenticate(r.Context(), cfg, user, pass, ip)
+		}
+		if !allow {
+			log.Printf("[StreamProxy] 认证失败: user=%s ip=%s", user, ip)
+			http.Error(w, "Invalid credentials", http.StatusForbidden)
+			return
+		}
+		ctx := context.WithValue(r.Context(), identityKey{}, identity{user: user, ip: ip})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// rewrite：按 rewrites 规则改写 path 参数（首个匹配的规则生效）
+func (p *Proxy) rewriteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := p.config(r.Context())
+		q := r.URL.Query()
+		path := q.Get("path")
+		if cfg == nil || path == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, rule := range cfg.Rewrites {
+			re, err := compileRewrite(rule.Match)
+			if err != nil {
+				continue
+			}
+			if re.MatchString(path) {
+				q.Set("path", re.ReplaceAllString(path, rule.Replace))
+				r2 := r.Clone(r.Context())
+				r2.URL.RawQuery = q.Encode()
+				r = r2
+				break
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var rewriteCache sync.Map // pattern -> *regexp.Regexp | error
+
+func compileRewrite(pattern string) (*regexp.Regexp, error) {
+	if v, ok := rewriteCache.Load(pattern); ok {
+		if re, ok := v.(*regexp.Regexp); ok {
+			return re, nil
+		}
+		return nil, v.(error)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Printf("[StreamProxy] 无效的 rewrite 规则 %q: %v", pattern, err)
+		rewriteCache.Store(pattern, err)
+		return nil, err
+	}
+	rewriteCache.Store(pattern, re)
+	return re, nil
+}
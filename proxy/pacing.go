@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// PCR 时钟频率（27MHz）
+const pcrHz = 27_000_000
+
+// 源时间跳变超过该值视为不连续（换片、回绕），重新对齐
+const pcrMaxJump = 10 * pcrHz
+
+// 输出限速：在读取上游时按源码率（PCR）或码率上限等待，避免把上游的突发原样推给客户端。
+// 允许超前 lead，用于起播时填充客户端缓冲
+type pacedReader struct {
+	io.ReadCloser
+	ctx  context.Context
+	lead time.Duration
+
+	// 源码率：PCR 与墙钟对齐
+	source   bool
+	pcrPID   int // -1 = 尚未选定
+	basePCR  int64
+	lastPCR  int64
+	baseTime time.Time
+	partial  [tsPacketSize]byte // 跨读取边界的半个包
+	partialN int
+
+	// 码率上限：虚拟时钟
+	bytesPerSec float64
+	due         time.Time
+}
+
+func newPacedReader(ctx context.Context, body io.ReadCloser, pc config.PacingCfg) io.ReadCloser {
+	if !pc.Source && pc.MaxKbps <= 0 {
+		return body
+	}
+	return &pacedReader{
+		ReadCloser:  body,
+		ctx:         ctx,
+		lead:        pc.Lead(),
+		source:      pc.Source,
+		pcrPID:      -1,
+		basePCR:     -1,
+		bytesPerSec: float64(pc.MaxKbps) * 1000 / 8,
+	}
+}
+
+func (p *pacedReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	if n == 0 {
+		return n, err
+	}
+	now := time.Now()
+	var wait time.Duration
+	if p.source {
+		if pcr, ok := p.scanPCR(b[:n]); ok {
+			wait = p.sourceWait(pcr, now)
+		}
+	}
+	if p.bytesPerSec > 0 {
+		// 落后超过 lead 时不追赶，避免积累突发
+		if floor := now.Add(-p.lead); p.due.Before(floor) {
+			p.due = floor
+		}
+		p.due = p.due.Add(time.Duration(float64(n) / p.bytesPerSec * float64(time.Second)))
+		wait = max(wait, p.due.Sub(now))
+	}
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-p.ctx.Done():
+			return n, context.Cause(p.ctx)
+		}
+	}
+	return n, err
+}
+
+// 按 PCR 计算需要等待的时间
+func (p *pacedReader) sourceWait(pcr int64, now time.Time) time.Duration {
+	if p.basePCR < 0 || pcr < p.lastPCR || pcr-p.lastPCR > pcrMaxJump {
+		p.basePCR, p.baseTime = pcr, now.Add(-p.lead)
+	}
+	p.lastPCR = pcr
+	target := p.baseTime.Add(time.Duration((pcr - p.basePCR) * int64(time.Second) / pcrHz))
+	if behind := now.Sub(target); behind > p.lead {
+		// 上游慢于源码率：平移基准，之后不突发追赶
+		p.baseTime = p.baseTime.Add(behind - p.lead)
+		return 0
+	}
+	return target.Sub(now)
+}
+
+// 返回本段数据中最后一个 PCR
+func (p *pacedReader) scanPCR(b []byte) (pcr int64, ok bool) {
+	if p.partialN > 0 {
+		need := tsPacketSize - p.partialN
+		if len(b) < need {
+			p.partialN += copy(p.partial[p.partialN:], b)
+			return 0, false
+		}
+		copy(p.partial[p.partialN:], b[:need])
+		p.partialN = 0
+		pcr, ok = p.packetPCR(p.partial[:])
+		b = b[need:]
+	}
+	if len(b) > 0 && b[0] != 0x47 {
+		off := tsSyncOffset(b)
+		if off < 0 {
+			return pcr, ok
+		}
+		b = b[off:]
+	}
+	for ; len(b) >= tsPacketSize; b = b[tsPacketSize:] {
+		if v, found := p.packetPCR(b[:tsPacketSize]); found {
+			pcr, ok = v, true
+		}
+	}
+	p.partialN = copy(p.partial[:], b)
+	return pcr, ok
+}
+
+// 解析单个 TS 包的 PCR；只跟随第一个携带 PCR 的 PID
+func (p *pacedReader) packetPCR(pkt []byte) (int64, bool) {
+	// adaptation field 存在、长度足够且 PCR_flag 置位
+	if pkt[0] != 0x47 || pkt[3]&0x20 == 0 || pkt[4] < 7 || pkt[5]&0x10 == 0 {
+		return 0, false
+	}
+	pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+	if p.pcrPID < 0 {
+		p.pcrPID = pid
+	} else if pid != p.pcrPID {
+		return 0, false
+	}
+	base := int64(pkt[6])<<25 | int64(pkt[7])<<17 | int64(pkt[8])<<9 | int64(pkt[9])<<1 | int64(pkt[10])>>7
+	ext := int64(pkt[10]&1)<<8 | int64(pkt[11])
+	return base*300 + ext, true
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// pin 参数与用户 PIN 一致时解除本次请求的屏蔽
+func pinMatches(want, got string) bool {
+	return want != "" && got != "" && subtle.ConstantTimeCompare([]byte(want), []byte(got)) == 1
+}
+
+// 家长控制：任一频道的分类被屏蔽且未提供正确的 pin 时返回 403
+func (p *Proxy) checkParental(w http.ResponseWriter, r *http.Request, cfg *config.Config, user string, chs ...config.ChannelCfg) bool {
+	got := r.URL.Query().Get("pin")
+	for _, ch := range chs {
+		blocked, pin := cfg.ParentalBlocked(user, ch)
+		if !blocked || pinMatches(pin, got) {
+			continue
+		}
+		if got != "" {
+			log.Printf("[StreamProxy] 家长控制 PIN 错误: user=%s path=%s", user, ch.Path)
+			http.Error(w, "Invalid PIN", http.StatusForbidden)
+			return false
+		}
+		http.Error(w, "Blocked by parental controls", http.StatusForbidden)
+		return false
+	}
+	return true
+}
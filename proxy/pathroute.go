@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// /stream/{path...}：上游路径放在 URL 路径中，取转义形式作为 path 参数。
+// streamHandler 经 config.NormalizePath 解码后做权限判断，上游地址使用重新转义的同一路径，
+// 因此 %3F、%2F 等编码字符仍按编码形式转发，而 v%69p 这类写法与 vip 视为同一频道
+func pathToQuery(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ok := strings.CutPrefix(r.URL.EscapedPath(), prefix)
+		if !ok || path == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		q := r.URL.Query()
+		q.Set("path", path)
+		r2 := r.Clone(r.Context())
+		r2.URL.RawQuery = q.Encode()
+		next.ServeHTTP(w, r2)
+	})
+}
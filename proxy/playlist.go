@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// 用户可观看的频道（按名称排序）；被家长控制屏蔽的频道仅在 pin 正确时列出，并记入 unlocked
+func watchableChannels(cfg *config.Config, user, pin string) (names []string, unlocked map[string]bool) {
+	names = make([]string, 0, len(cfg.Channels))
+	unlocked = map[string]bool{}
+	for name, ch := range cfg.Channels {
+		if !cfg.CanWatch(user, ch) {
+			continue
+		}
+		if blocked, want := cfg.ParentalBlocked(user, ch); blocked {
+			if !pinMatches(want, pin) {
+				continue
+			}
+			unlocked[name] = true
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, unlocked
+}
+
+// GET /playlist.m3u：生成当前用户可观看频道的 M3U 播放列表，条目沿用本次请求的凭据；
+// 被家长控制屏蔽的频道仅在带正确 pin 时列出
+func (p *Proxy) playlistHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := p.config(r.Context())
+	if cfg == nil {
+		http.Error(w, "Unknown tenant", http.StatusNotFound)
+		return
+	}
+	id, ok := identityFrom(r.Context())
+	if !ok {
+		log.Printf("[StreamProxy] 路由 %s 未配置 auth 中间件，拒绝请求", r.URL.Path)
+		http.Error(w, "Authentication required", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	names, unlocked := watchableChannels(cfg, id.user, q.Get("pin"))
+
+	// 租户按前缀匹配时，条目地址需要带上前缀
+	base := "/stream"
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		base = strings.TrimSuffix(u.Path, "/playlist.m3u") + "/stream"
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, name := range names {
+		v := url.Values{"channel": {name}, "user": {q.Get("user")}, "pass": {q.Get("pass")}}
+		if unlocked[name] {
+			v.Set("pin", q.Get("pin"))
+		}
+		fmt.Fprintf(&b, "#EXTINF:-1 tvg-id=%q,%s\n%s://%s%s?%s\n", name, name, scheme, r.Host, base, v.Encode())
+	}
+	w.Write([]byte(b.String()))
+}
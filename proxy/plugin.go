@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// 插件挂载点
+const (
+	hookAuthenticate = "authenticate"
+	hookAuthorize    = "authorize"
+	hookSessionStart = "session_start"
+	hookSessionEnd   = "session_end"
+)
+
+// 传给插件的事件（写入 stdin）
+type pluginEvent struct {
+	Hook       string `json:"hook"`
+	Tenant     string `json:"tenant,omitempty"`
+	User       string `json:"user"`
+	Pass       string `json:"pass,omitempty"` // 仅 authenticate
+	IP         string `json:"ip"`
+	Channel    string `json:"channel,omitempty"`
+	Path       string `json:"path,omitempty"`
+	SessionID  uint64 `json:"session_id,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"`       // 仅 session_end
+	DurationMS int64  `json:"duration_ms,omitempty"` // 仅 session_end
+	Reason     string `json:"reason,omitempty"`      // 仅 session_end：结束原因
+}
+
+// 插件输出（从 stdout 读取）；session_* 挂载点的输出被忽略
+type pluginResult struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// 每个插件的并发槽位，max_concurrent 变化后按新上限另建
+type pluginSlots struct {
+	mu sync.Mutex
+	m  map[string]chan struct{} // name + 上限
+}
+
+func newPluginSlots() *pluginSlots {
+	return &pluginSlots{m: map[string]chan struct{}{}}
+}
+
+// acquire 等待一个空闲槽位，返回释放函数；未设上限时直接返回
+func (s *pluginSlots) acquire(ctx context.Context, pc config.PluginCfg) (func(), error) {
+	if pc.MaxConcurrent <= 0 {
+		return func() {}, nil
+	}
+	key := fmt.Sprintf("%s\x00%d", pc.Name, pc.MaxConcurrent)
+	s.mu.Lock()
+	ch, ok := s.m[key]
+	if !ok {
+		ch = make(chan struct{}, pc.MaxConcurrent)
+		s.m[key] = ch
+	}
+	s.mu.Unlock()
+	select {
+	case ch <- struct{}{}:
+		return func() { <-ch }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// args/env 模板可用的函数
+var pluginFuncs = template.FuncMap{
+	"hasPrefix":  strings.HasPrefix,
+	"hasSuffix":  strings.HasSuffix,
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+	"contains":   strings.Contains,
+	"replace":    strings.ReplaceAll,
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"split":      strings.Split,
+	"join":       strings.Join,
+	"urlEscape":  url.QueryEscape,
+	"regexReplace": func(pattern, repl, s string) (string, error) {
+		re, err := compileRewrite(pattern)
+		if err != nil {
+			return "", err
+		}
+		return re.ReplaceAllString(s, repl), nil
+	},
+}
+
+// 展开 args/env 中的模板；不含 {{ 的值原样返回
+func expandPlugin(s string, ev pluginEvent) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	t, err := template.New("").Funcs(pluginFuncs).Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, ev); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func pluginCommand(ctx context.Context, pc config.PluginCfg, ev pluginEvent) (*exec.Cmd, error) {
+	args := make([]string, len(pc.Args))
+	for i, a := range pc.Args {
+		v, err := expandPlugin(a, ev)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: args[%d]: %w", pc.Name, i, err)
+		}
+		args[i] = v
+	}
+	cmd := exec.CommandContext(ctx, pc.Exec, args...)
+	if len(pc.Env) > 0 {
+		cmd.Env = os.Environ()
+		for k, e := range pc.Env {
+			v, err := expandPlugin(e, ev)
+			if err != nil {
+				return nil, fmt.Errorf("plugin %s: env %s: %w", pc.Name, k, err)
+			}
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+	return cmd, nil
+}
+
+// 执行一次插件：每次调用启动一个进程，stdin 写入事件 JSON，stdout 读取结果 JSON
+func (p *Proxy) runPlugin(ctx context.Context, pc config.PluginCfg, ev pluginEvent) (pluginResult, error) {
+	var res pluginResult
+	wait, cancelWait := context.WithTimeout(ctx, pc.Timeout())
+	release, err := p.pluginSlots.acquire(wait, pc)
+	cancelWait()
+	if err != nil {
+		p.metrics.pluginDropped.Add(1)
+		return res, fmt.Errorf("plugin %s: no free slot (max_concurrent=%d)", pc.Name, pc.MaxConcurrent)
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(ctx, pc.Timeout())
+	defer cancel()
+	in, err := json.Marshal(ev)
+	if err != nil {
+		return res, err
+	}
+	cmd, err := pluginCommand(ctx, pc, ev)
+	if err != nil {
+		return res, err
+	}
+	cmd.Stdin = bytes.NewReader(in)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return res, fmt.Errorf("plugin %s: %w (%s)", pc.Name, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if ev.Hook == hookSessionStart || ev.Hook == hookSessionEnd {
+		return res, nil
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return res, fmt.Errorf("plugin %s: bad output: %w", pc.Name, err)
+	}
+	return res, nil
+}
+
+func pluginsFor(cfg *config.Config, hook string) []config.PluginCfg {
+	var out []config.PluginCfg
+	for _, pc := range cfg.Plugins {
+		if slices.Contains(pc.Hooks, hook) {
+			out = append(out, pc)
+		}
+	}
+	return out
+}
+
+// 认证结果缓存，避免每个请求都启动插件进程
+type authCache struct {
+	mu sync.Mutex
+	m  map[string]authCacheEntry // tenant + user + sha256(pass)
+}
+
+type authCacheEntry struct {
+	tenant  string
+	user    string
+	allow   bool
+	expires time.Time
+}
+
+func newAuthCache() *authCache {
+	return &authCache{m: map[string]authCacheEntry{}}
+}
+
+func authCacheKey(tenant, user, pass string) string {
+	h := sha256.Sum256([]byte(pass))
+	return tenant + "\x00" + user + "\x00" + string(h[:])
+}
+
+func (c *authCache) get(tenant, user, pass string) (allow, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[authCacheKey(tenant, user, pass)]
+	if !ok || time.Now().After(e.expires) {
+		return false, false
+	}
+	return e.allow, true
+}
+
+func (c *authCache) put(tenant, user, pass string, allow bool, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, e := range c.m {
+		if now.After(e.expires) {
+			delete(c.m, k)
+		}
+	}
+	c.m[authCacheKey(tenant, user, pass)] = authCacheEntry{tenant: tenant, user: user, allow: allow, expires: now.Add(ttl)}
+}
+
+// forget 清除某用户的缓存结果，下次请求重新走插件认证
+func (c *authCache) forget(tenant, user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.m {
+		if e.tenant == tenant && e.user == user {
+			delete(c.m, k)
+		}
+	}
+}
+
+// 内置用户校验失败后，依次询问 authenticate 插件，任一放行即通过
+func (p *Proxy) pluginAuthenticate(ctx context.Context, cfg *config.Config, user, pass, ip string) bool {
+	plugins := pluginsFor(cfg, hookAuthenticate)
+	if len(plugins) == 0 {
+		return false
+	}
+	if allow, ok := p.authCache.get(cfg.TenantName(), user, pass); ok {
+		return allow
+	}
+	allow := false
+	var ttl time.Duration
+	for _, pc := range plugins {
+		res, err := p.runPlugin(ctx, pc, pluginEvent{Hook: hookAuthenticate, Tenant: cfg.TenantName(), User: user, Pass: pass, IP: ip})
+		if err != nil {
+			log.Printf("[StreamProxy] 认证插件失败: %v", err)
+			continue
+		}
+		if res.Allow {
+			allow, ttl = true, time.Duration(pc.CacheSec)*time.Second
+			break
+		}
+		ttl = max(ttl, time.Duration(pc.CacheSec)*time.Second)
+	}
+	if ttl > 0 {
+		p.authCache.put(cfg.TenantName(), user, pass, allow, ttl)
+	}
+	return allow
+}
+
+// 所有 authorize 插件都放行才允许；插件出错时按 fail_open 决定
+func (p *Proxy) pluginAuthorize(ctx context.Context, cfg *config.Config, ev pluginEvent) (bool, string) {
+	ev.Hook = hookAuthorize
+	for _, pc := range pluginsFor(cfg, hookAuthorize) {
+		res, err := p.runPlugin(ctx, pc, ev)
+		if err != nil {
+			log.Printf("[StreamProxy] 授权插件失败: %v", err)
+			if pc.FailOpen {
+				continue
+			}
+			return false, "authorization unavailable"
+		}
+		if !res.Allow {
+			return false, res.Reason
+		}
+	}
+	return true, ""
+}
+
+// 会话开始/结束通知，异步执行，不影响流
+func (p *Proxy) pluginNotify(cfg *config.Config, ev pluginEvent) {
+	for _, pc := range pluginsFor(cfg, ev.Hook) {
+		go func() {
+			if _, err := p.runPlugin(context.Background(), pc, ev); err != nil {
+				log.Printf("[StreamProxy] %s 插件失败: %v", ev.Hook, err)
+			}
+		}()
+	}
+}
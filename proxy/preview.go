@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+var errPreviewEnded = errors.New("preview time used up")
+
+const resultPreviewEnded = "preview_ended"
+
+// slate 文件大小上限
+const maxSlateSize = 8 << 20
+
+// 试看计时：记录每个用户在每个频道上首次试看的时间
+type previewTracker struct {
+	mu sync.Mutex
+	m  map[string]time.Time
+}
+
+func newPreviewTracker() *previewTracker {
+	return &previewTracker{m: map[string]time.Time{}}
+}
+
+// allow 返回本次还能播放的时长；冷却期内 ok 为 false，retry 为距离冷却结束的时间
+func (t *previewTracker) allow(key string, pv config.PreviewCfg) (left, retry time.Duration, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	window := time.Duration(pv.Seconds) * time.Second
+	start, seen := t.m[key]
+	if !seen || now.Sub(start) >= max(pv.Cooldown(), window) {
+		if len(t.m) >= 4096 {
+			// 清理已过冷却期的记录
+			for k, s := range t.m {
+				if now.Sub(s) >= max(pv.Cooldown(), window) {
+					delete(t.m, k)
+				}
+			}
+		}
+		t.m[key] = now
+		return window, 0, true
+	}
+	if left := start.Add(window).Sub(now); left > 0 {
+		return left, 0, true
+	}
+	return 0, start.Add(pv.Cooldown()).Sub(now), false
+}
+
+// 试看结束时追加 slate（通常是一段提示画面），失败只记录日志
+func writeSlate(w http.ResponseWriter, path string) {
+	if path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("[StreamProxy] 打开 slate 失败: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := io.Copy(w, io.LimitReader(f, maxSlateSize)); err != nil {
+		return
+	}
+	_ = http.NewResponseController(w).Flush()
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// 探测时最多读取的数据量
+const probeReadLimit = 64 << 10
+
+// ProbeResult 单个频道的探测结果
+type ProbeResult struct {
+	Tenant    string    `json:"tenant,omitempty"`
+	Channel   string    `json:"channel"`
+	OK        bool      `json:"ok"`
+	Kind      string    `json:"kind,omitempty"` // ts / hls / dash
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMS int64     `json:"latency_ms"` // 收到有效数据的耗时
+	Checked   time.Time `json:"checked"`
+}
+
+// 后台探测的最近结果，键为 租户\x00频道
+type prober struct {
+	mu      sync.Mutex
+	results map[string]ProbeResult
+}
+
+func newProber() *prober {
+	return &prober{results: map[string]ProbeResult{}}
+}
+
+func (pr *prober) list() []ProbeResult {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	out := make([]ProbeResult, 0, len(pr.results))
+	for _, r := range pr.results {
+		out = append(out, r)
+	}
+	slices.SortFunc(out, func(a, b ProbeResult) int {
+		return strings.Compare(a.Tenant+"\x00"+a.Channel, b.Tenant+"\x00"+b.Channel)
+	})
+	return out
+}
+
+// 用本轮结果整体替换，已删除的频道随之消失
+func (pr *prober) replace(results []ProbeResult) {
+	m := make(map[string]ProbeResult, len(results))
+	for _, r := range results {
+		m[r.Tenant+"\x00"+r.Channel] = r
+	}
+	pr.mu.Lock()
+	pr.results = m
+	pr.mu.Unlock()
+}
+
+// ProbeChannel 立即探测一个频道；租户或频道不存在时 ok 为 false
+func (p *Proxy) ProbeChannel(ctx context.Context, tenant, channel string) (ProbeResult, bool) {
+	cfg := p.src.Get()
+	if tenant != "" {
+		if cfg = cfg.Tenant(tenant); cfg == nil {
+			return ProbeResult{}, false
+		}
+	}
+	ch, ok := cfg.Channels[channel]
+	if !ok {
+		return ProbeResult{}, false
+	}
+	return p.probe(ctx, cfg, channel, ch), true
+}
+
+// ProbeAll 返回所有频道的探测结果：启用了后台探测时返回最近一轮结果，否则立即探测
+func (p *Proxy) ProbeAll(ctx context.Context) []ProbeResult {
+	if p.src.Get().Probe.IntervalSec > 0 {
+		return p.prober.list()
+	}
+	return p.probeAll(ctx)
+}
+
+func (p *Proxy) probeAll(ctx context.Context) []ProbeResult {
+	root := p.src.Get()
+	type job struct {
+		cfg  *config.Config
+		name string
+		ch   config.ChannelCfg
+	}
+	var jobs []job
+	for _, cfg := range append([]*config.Config{root}, tenantViews(root)...) {
+		for name, ch := range cfg.Channels {
+			jobs = append(jobs, job{cfg, name, ch})
+		}
+	}
+	results := make([]ProbeResult, len(jobs))
+	sem := make(chan struct{}, root.Probe.Workers())
+	var wg sync.WaitGroup
+	for i, j := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = p.probe(ctx, j.cfg, j.name, j.ch)
+		}()
+	}
+	wg.Wait()
+	slices.SortFunc(results, func(a, b ProbeResult) int {
+		return strings.Compare(a.Tenant+"\x00"+a.Channel, b.Tenant+"\x00"+b.Channel)
+	})
+	return results
+}
+
+func tenantViews(root *config.Config) []*config.Config {
+	var out []*config.Config
+	for name := range root.Tenants {
+		if t := root.Tenant(name); t != nil {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// 拉取频道上游开头的一段数据，检查是否为有效的 TS / HLS 播放列表 / DASH MPD
+func (p *Proxy) probe(ctx context.Context, cfg *config.Config, name string, ch config.ChannelCfg) ProbeResult {
+	res := ProbeResult{Tenant: cfg.TenantName(), Channel: name, Checked: time.Now()}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Probe.Timeout())
+	defer cancel()
+	start := time.Now()
+	fail := func(err error) ProbeResult {
+		res.Error = err.Error()
+		res.LatencyMS = time.Since(start).Milliseconds()
+		return res
+	}
+
+	target := baseUpstreamURL(cfg, ch.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return fail(err)
+	}
+	req.Header.Set("Accept", "*/*")
+	resp, err := p.upstreamDo(cfg, req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	res.Status = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fail(fmt.Errorf("upstream status %d", resp.StatusCode))
+	}
+
+	ct := resp.Header.Get("Content-Type")
+	var buf bytes.Buffer
+	lr := io.LimitReader(resp.Body, probeReadLimit)
+	chunk := make([]byte, 8<<10)
+	for {
+		n, rerr := lr.Read(chunk)
+		buf.Write(chunk[:n])
+		if kind, ok := probeValid(target, ct, buf.Bytes()); ok {
+			res.OK, res.Kind = true, kind
+			res.LatencyMS = time.Since(start).Milliseconds()
+			return res
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				break
+			}
+			return fail(rerr)
+		}
+	}
+	if buf.Len() == 0 {
+		return fail(fmt.Errorf("empty response"))
+	}
+	return fail(fmt.Errorf("invalid data (%d bytes)", buf.Len()))
+}
+
+// 清单只要开头正确；TS 需要连续 3 个同步字节
+func probeValid(target, ct string, b []byte) (string, bool) {
+	switch {
+	case isPlaylist(target, ct):
+		return "hls", bytes.HasPrefix(bytes.TrimLeft(b, "\ufeff \r\n\t"), []byte("#EXTM3U"))
+	case isDASH(target, ct):
+		return "dash", bytes.Contains(b, []byte("<MPD"))
+	}
+	if len(b) < 3*tsPacketSize {
+		return "ts", false
+	}
+	off := tsSyncOffset(b)
+	if off < 0 || off+3*tsPacketSize > len(b) {
+		return "ts", false
+	}
+	return "ts", b[off+tsPacketSize] == 0x47 && b[off+2*tsPacketSize] == 0x47
+}
+
+// 后台定时探测所有频道；interval_sec 为 0 时关闭（可热加载开启）
+func (p *Proxy) probeLoop(ctx context.Context) {
+	for {
+		interval := p.src.Get().Probe.Interval()
+		if interval > 0 {
+			p.prober.replace(p.probeAll(ctx))
+		} else {
+			p.prober.replace(nil)
+			interval = 5 * time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package proxy 实现带认证的流媒体转发，可嵌入其他 Go 服务：
+//
+//	p := proxy.New(config.Static(cfg))
+//	http.Handle("/", p.Handler())
+//	go p.Run(ctx)
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+type Proxy struct {
+	src          config.Source
+	client       *http.Client
+	sessions     *sessionRegistry
+	channelStats *channelStats
+	admission    *admission
+	cache        *responseCache
+	limiter      *rateLimiter
+	authCache    *authCache
+	pluginSlots  *pluginSlots
+	dlnaSecret   string // 未配置 dlna.token 时使用
+	scripts      *scriptCache
+	history      historyHolder
+	resume       *resumePool
+	variants     *variantIndex
+	transcoder   *transcoder
+	snapshots    *snapshotCache
+	previews     *previewTracker
+	recorder     *recorder
+	maint        maintenance
+	prober       *prober
+	quota        *quotaTracker
+	cluster      *cluster
+	standby      atomic.Bool
+	build        BuildInfo
+	sni          sniClients
+	metrics      metrics
+
+	mwMu        sync.Mutex
+	middlewares map[string]Middleware
+	chains      map[string]http.Handler // 已组装的链，配置变化后重建
+	chainsCfg   *config.Config
+}
+
+// New 创建代理实例；配置通过 src 读取，支持热加载
+func New(src config.Source) *Proxy {
+	p := &Proxy{
+		src:          src,
+		dlnaSecret:   newDLNAToken(),
+		sessions:     newSessionRegistry(),
+		admission:    newAdmission(),
+		cache:        newResponseCache(),
+		limiter:      newRateLimiter(),
+		authCache:    newAuthCache(),
+		pluginSlots:  newPluginSlots(),
+		scripts:      newScriptCache(),
+		resume:       newResumePool(),
+		variants:     newVariantIndex(),
+		transcoder:   newTranscoder(),
+		snapshots:    newSnapshotCache(),
+		previews:     newPreviewTracker(),
+		recorder:     newRecorder(),
+		prober:       newProber(),
+		quota:        newQuotaTracker(),
+		cluster:      newCluster(),
+		channelStats: newChannelStats(),
+	}
+	p.client = newHTTPClient(p.dialUpstream)
+	p.middlewares = p.builtinMiddlewares()
+	return p
+}
+
+// 高性能 HTTP 客户端
+func newHTTPClient(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dial,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          512,
+			MaxIdleConnsPerHost:   256,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   4 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			ResponseHeaderTimeout: 5 * time.Second,
+		},
+		Timeout: 0, // 流式不设总超时
+	}
+}
+
+// Handler 返回 /stream 与 /metrics 路由
+func (p *Proxy) Handler() http.Handler {
+	mux := http.NewServeMux()
+	stream := p.route("/stream", p.streamHandler)
+	mux.Handle("/stream", stream)
+	mux.Handle("/stream/{path...}", pathToQuery("/stream/", stream))
+	mux.Handle("/snapshot", p.route("/snapshot", p.snapshotHandler))
+	mux.Handle("/playlist.m3u", p.route("/playlist.m3u", p.playlistHandler))
+	mux.Handle("/recordings", p.route("/recordings", p.recordListHandler))
+	mux.Handle("/recordings/start", p.route("/recordings/start", p.recordStartHandler))
+	mux.Handle("/recordings/stop", p.route("/recordings/stop", p.recordStopHandler))
+	mux.Handle("/recordings/download", p.route("/recordings/download", p.recordDownloadHandler))
+	mux.Handle("/recordings/delete", p.route("/recordings/delete", p.recordDeleteHandler))
+	mux.HandleFunc("/metrics", p.metricsHandler)
+	mux.HandleFunc("/dlna/", p.dlnaHandler)
+	return p.tenantRouter(mux)
+}
+
+// Run 执行后台任务（空闲流巡检、配置变更跟踪、频道探测），直到 ctx 结束；
+// 结束时取消所有活跃会话并释放到源站的空闲连接
+func (p *Proxy) Run(ctx context.Context) {
+	go p.watchConfig(ctx)
+	go p.probeLoop(ctx)
+	go p.quotaLoop(ctx)
+	go p.scheduleWatchdog(ctx)
+	go p.clusterLoop(ctx)
+	go p.ssdpLoop(ctx)
+	p.idleWatchdog(ctx)
+	p.cancelAll(errShutdown)
+	p.resume.closeAll()
+	p.transcoder.closeAll()
+	p.recorder.closeAll()
+	p.closeIdleUpstreams()
+	if f := p.src.Get().Quota.StateFile; f != "" {
+		p.quota.save(f)
+	}
+	p.history.close()
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// 代理自身使用的参数，永不透传
+var reservedParams = []string{"user", "pass", "path", "channel", "pin", "dlna_token"}
+
+// 把需透传的参数追加到 targetURL；已有查询串原样保留（签名 URL 对顺序/编码敏感）
+func appendPassthroughQuery(targetURL string, in url.Values, qc config.QueryCfg) string {
+	if qc.Mode != "all" && qc.Mode != "allow" {
+		return targetURL
+	}
+	extra := url.Values{}
+	for k, vs := range in {
+		if slices.Contains(reservedParams, k) {
+			continue
+		}
+		if qc.Mode == "allow" && !slices.Contains(qc.Allow, k) {
+			continue
+		}
+		extra[k] = vs
+	}
+	if len(extra) == 0 {
+		return targetURL
+	}
+	sep := "?"
+	if strings.Contains(targetURL, "?") {
+		sep = "&"
+	}
+	return targetURL + sep + extra.Encode()
+}
@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+var errQuotaExceeded = errors.New("data quota exceeded")
+
+const resultQuotaExceeded = "quota_exceeded"
+
+// QuotaUsage 用户在当前计费周期的流量
+type QuotaUsage struct {
+	User       string    `json:"user"` // 租户用户为 租户/用户名
+	UsedBytes  int64     `json:"used_bytes"`
+	LimitBytes int64     `json:"limit_bytes"` // 0 = 不限
+	Exceeded   bool      `json:"exceeded"`
+	Period     time.Time `json:"period"`
+}
+
+// 流量统计，键为 租户/用户名（与 Kick 相同）；计数器只清零不替换，进行中的写入无需重新查找
+type quotaTracker struct {
+	mu     sync.Mutex
+	period time.Time
+	used   map[string]*atomic.Int64
+	remote map[string]*atomic.Int64 // 集群中其它节点的用量
+	saved  map[string]int64         // 上次保存时的值，用于判断是否需要写盘
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{used: map[string]*atomic.Int64{}, remote: map[string]*atomic.Int64{}}
+}
+
+func quotaKey(tenant, user string) string {
+	if tenant == "" {
+		return user
+	}
+	return tenant + "/" + user
+}
+
+func (q *quotaTracker) counter(key string) *atomic.Int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return counterIn(q.used, key)
+}
+
+func (q *quotaTracker) remoteCounter(key string) *atomic.Int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return counterIn(q.remote, key)
+}
+
+func counterIn(m map[string]*atomic.Int64, key string) *atomic.Int64 {
+	c := m[key]
+	if c == nil {
+		c = new(atomic.Int64)
+		m[key] = c
+	}
+	return c
+}
+
+// 用集群汇总结果覆盖其它节点的用量
+func (q *quotaTracker) setRemote(sums map[string]int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for k, c := range q.remote {
+		c.Store(sums[k])
+	}
+	for k, v := range sums {
+		counterIn(q.remote, k).Store(v)
+	}
+}
+
+// 进入新的计费周期时清零
+func (q *quotaTracker) roll(start time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.period.Equal(start) {
+		return
+	}
+	if !q.period.IsZero() {
+		log.Printf("[StreamProxy] 流量配额进入新周期 %s，用量清零", start.Format("2006-01-02"))
+	}
+	q.period = start
+	for _, c := range q.used {
+		c.Store(0)
+	}
+}
+
+func (q *quotaTracker) reset(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	c, ok := q.used[key]
+	if ok {
+		c.Store(0)
+	}
+	return ok
+}
+
+type quotaState struct {
+	Period time.Time        `json:"period"`
+	Usage  map[string]int64 `json:"usage"`
+}
+
+func (q *quotaTracker) snapshot() quotaState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := quotaState{Period: q.period, Usage: make(map[string]int64, len(q.used))}
+	for k, c := range q.used {
+		if v := c.Load(); v > 0 {
+			st.Usage[k] = v
+		}
+	}
+	return st
+}
+
+// 启动时恢复同一周期的用量
+func (q *quotaTracker) load(path string, start time.Time) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[StreamProxy] 读取流量配额状态失败: %v", err)
+		}
+		return
+	}
+	var st quotaState
+	if err := json.Unmarshal(b, &st); err != nil {
+		log.Printf("[StreamProxy] 解析流量配额状态失败: %v", err)
+		return
+	}
+	if !st.Period.Equal(start) {
+		return
+	}
+	for k, v := range st.Usage {
+		q.counter(k).Add(v)
+	}
+	q.saved = st.Usage
+}
+
+func (q *quotaTracker) save(path string) {
+	st := q.snapshot()
+	if maps.Equal(st.Usage, q.saved) {
+		return
+	}
+	b, _ := json.Marshal(st)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		log.Printf("[StreamProxy] 保存流量配额状态失败: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("[StreamProxy] 保存流量配额状态失败: %v", err)
+		return
+	}
+	q.saved = st.Usage
+}
+
+// 按周期清零并定时保存（退出时由 Run 再保存一次）
+func (p *Proxy) quotaLoop(ctx context.Context) {
+	cfg := p.src.Get()
+	p.quota.roll(cfg.QuotaPeriodStart(time.Now()))
+	if cfg.Quota.StateFile != "" {
+		p.quota.load(cfg.Quota.StateFile, cfg.QuotaPeriodStart(time.Now()))
+	}
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		cfg = p.src.Get()
+		p.quota.roll(cfg.QuotaPeriodStart(time.Now()))
+		if cfg.Quota.StateFile != "" {
+			p.quota.save(cfg.Quota.StateFile)
+		}
+	}
+}
+
+// 统计写给客户端的字节；超出配额后按 block 返回错误，按 throttle 限速
+type quotaWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	used        *atomic.Int64
+	remote      *atomic.Int64
+	limit       int64
+	bytesPerSec float64 // 0 = block
+	due         time.Time
+}
+
+// 用户有配额时包装 w；已超出且为 block 时返回 false
+func (p *Proxy) quotaWriter(ctx context.Context, w http.ResponseWriter, cfg *config.Config, user string) (http.ResponseWriter, bool) {
+	limit := cfg.QuotaFor(user)
+	if limit <= 0 {
+		return w, true
+	}
+	key := quotaKey(cfg.TenantName(), user)
+	qw := &quotaWriter{ResponseWriter: w, ctx: ctx, used: p.quota.counter(key), remote: p.quota.remoteCounter(key), limit: limit}
+	if cfg.Quota.Action == config.QuotaThrottle {
+		qw.bytesPerSec = float64(cfg.Quota.Kbps()) * 1000 / 8
+	}
+	return qw, qw.bytesPerSec > 0 || !qw.exceeded()
+}
+
+func (q *quotaWriter) exceeded() bool {
+	return q.used.Load()+q.remote.Load() >= q.limit
+}
+
+func (q *quotaWriter) Write(b []byte) (int, error) {
+	if q.exceeded() {
+		if q.bytesPerSec == 0 {
+			return 0, errQuotaExceeded
+		}
+		now := time.Now()
+		if q.due.Before(now) {
+			q.due = now
+		}
+		q.due = q.due.Add(time.Duration(float64(len(b)) / q.bytesPerSec * float64(time.Second)))
+		if wait := q.due.Sub(now); wait > 0 {
+			t := time.NewTimer(wait)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-q.ctx.Done():
+				return 0, context.Cause(q.ctx)
+			}
+		}
+	}
+	n, err := q.ResponseWriter.Write(b)
+	q.used.Add(int64(n))
+	return n, err
+}
+
+// 供 http.ResponseController 找到底层连接
+func (q *quotaWriter) Unwrap() http.ResponseWriter { return q.ResponseWriter }
+
+// QuotaUsages 返回当前周期所有有用量的用户；user 非空时只返回该用户（租户用户为 租户/用户名）
+func (p *Proxy) QuotaUsages(user string) []QuotaUsage {
+	root := p.src.Get()
+	st := p.quota.snapshot()
+	p.quota.mu.Lock()
+	for k, c := range p.quota.remote {
+		st.Usage[k] += c.Load()
+	}
+	p.quota.mu.Unlock()
+	out := []QuotaUsage{}
+	for key, used := range st.Usage {
+		if used == 0 {
+			continue
+		}
+		if user != "" && key != user {
+			continue
+		}
+		cfg, name := root, key
+		if tenant, u, ok := strings.Cut(key, "/"); ok {
+			if tc := root.Tenant(tenant); tc != nil {
+				cfg, name = tc, u
+			}
+		}
+		limit := cfg.QuotaFor(name)
+		out = append(out, QuotaUsage{User: key, UsedBytes: used, LimitBytes: limit, Exceeded: limit > 0 && used >= limit, Period: st.Period})
+	}
+	slices.SortFunc(out, func(a, b QuotaUsage) int { return strings.Compare(a.User, b.User) })
+	return out
+}
+
+// ResetQuota 清零单个用户当前周期的用量（集群模式下同时清零其它节点）
+func (p *Proxy) ResetQuota(ctx context.Context, user string) bool {
+	ok := p.quota.reset(user)
+	if p.broadcast(ctx, clusterCommand{Op: clusterQuotaReset, User: user}) > 0 {
+		ok = true
+	}
+	p.quota.mu.Lock()
+	if c := p.quota.remote[user]; c != nil {
+		c.Store(0)
+	}
+	p.quota.mu.Unlock()
+	return ok
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/auth"
+	"r9mc.com/stream-proxy/config"
+)
+
+// 按客户端 IP 的令牌桶
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	calls   int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*tokenBucket{}}
+}
+
+func (l *rateLimiter) allow(key string, rc config.RateLimitCfg) bool {
+	burst := float64(rc.Burst)
+	if burst <= 0 {
+		burst = max(1, rc.RPS)
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// 定期清理已回满的桶，防止 map 无限增长
+	if l.calls++; l.calls%1024 == 0 {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rc.RPS >= burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rc.RPS)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ratelimit：超限返回 429
+func (p *Proxy) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := p.src.Get()
+		if cfg.RateLimit.RPS > 0 && !p.limiter.allow(auth.ClientIP(r, cfg.TrustedProxyPrefixes()), cfg.RateLimit) {
+			p.metrics.rateLimited.Add(1)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,588 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// 录制状态
+const (
+	recRecording     = "recording"
+	recCompleted     = "completed"      // 上游结束或达到时长上限
+	recStopped       = "stopped"        // 用户停止
+	recQuotaExceeded = "quota_exceeded" // 达到用户配额
+	recFailed        = "failed"
+	recInterrupted   = "interrupted" // 服务关闭
+)
+
+var (
+	errRecStopped   = errors.New("recording stopped by user")
+	errRecQuota     = errors.New("recording quota exceeded")
+	errRecMaxLength = errors.New("recording reached max duration")
+	errRecTooMany   = errors.New("too many active recordings")
+
+	recIDPattern = regexp.MustCompile(`^\d{8}-\d{6}-[0-9a-f]{6}$`)
+	safeName     = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+// Recording 录制元数据，保存在 <id>.json
+type Recording struct {
+	ID      string     `json:"id"`
+	Channel string     `json:"channel"`
+	Start   time.Time  `json:"start"`
+	End     *time.Time `json:"end,omitempty"`
+	Bytes   int64      `json:"bytes"`
+	Status  string     `json:"status"`
+	Error   string     `json:"error,omitempty"`
+}
+
+type activeRecording struct {
+	meta    Recording
+	dir     string
+	owner   string // 用户目录
+	cancel  context.CancelCauseFunc
+	written atomic.Int64
+}
+
+type recorder struct {
+	mu     sync.Mutex
+	active map[string]*activeRecording // id -> 录制
+	usage  map[string]*atomic.Int64    // 用户目录 -> 已占用字节
+	wg     sync.WaitGroup
+	closed bool
+}
+
+func newRecorder() *recorder {
+	return &recorder{active: map[string]*activeRecording{}, usage: map[string]*atomic.Int64{}}
+}
+
+// 用户目录：dir/<租户>/<用户>，不安全的名字转成十六进制
+func recordingDir(cfg *config.Config, user string) string {
+	return filepath.Join(cfg.Recording.Dir, fsName(cmp.Or(cfg.TenantName(), "_default")), fsName(user))
+}
+
+func fsName(s string) string {
+	if safeName.MatchString(s) && s != "." && s != ".." {
+		return s
+	}
+	return "x-" + hex.EncodeToString([]byte(s))
+}
+
+func newRecordingID() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b)
+}
+
+// 用户已占用空间；首次使用时从磁盘统计
+func (rc *recorder) usageOf(dir string) *atomic.Int64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	u := rc.usage[dir]
+	if u == nil {
+		u = new(atomic.Int64)
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if info, err := e.Info(); err == nil && strings.HasSuffix(e.Name(), ".ts") {
+				u.Add(info.Size())
+			}
+		}
+		rc.usage[dir] = u
+	}
+	return u
+}
+
+// 检查活动数上限并登记，两步在同一次加锁内完成
+func (rc *recorder) add(a *activeRecording, limit int) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return errShutdown
+	}
+	n := 0
+	for _, o := range rc.active {
+		if o.owner == a.owner {
+			n++
+		}
+	}
+	if n >= limit {
+		return errRecTooMany
+	}
+	rc.active[a.meta.ID] = a
+	rc.wg.Add(1)
+	return nil
+}
+
+func (rc *recorder) remove(id string) {
+	rc.mu.Lock()
+	delete(rc.active, id)
+	rc.mu.Unlock()
+}
+
+func (rc *recorder) activeFor(dir string) []*activeRecording {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var out []*activeRecording
+	for _, a := range rc.active {
+		if a.owner == dir {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// 关闭时停止所有录制并等待元数据写完
+func (rc *recorder) closeAll() {
+	rc.mu.Lock()
+	rc.closed = true
+	for _, a := range rc.active {
+		a.cancel(errShutdown)
+	}
+	rc.mu.Unlock()
+	rc.wg.Wait()
+}
+
+func writeRecordingMeta(dir string, m Recording) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, m.ID+".json.tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, m.ID+".json"))
+}
+
+func readRecordingMeta(dir, id string) (Recording, error) {
+	var m Recording
+	b, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(b, &m)
+}
+
+// 录制接口公共部分：配置、身份与用户目录
+func (p *Proxy) recordingContext(w http.ResponseWriter, r *http.Request) (*config.Config, identity, string, bool) {
+	cfg := p.config(r.Context())
+	if cfg == nil {
+		http.Error(w, "Unknown tenant", http.StatusNotFound)
+		return nil, identity{}, "", false
+	}
+	if cfg.Recording.Dir == "" {
+		http.Error(w, "Recording not enabled", http.StatusNotFound)
+		return nil, identity{}, "", false
+	}
+	id, ok := identityFrom(r.Context())
+	if !ok {
+		log.Printf("[StreamProxy] 路由 %s 未配置 auth 中间件，拒绝请求", r.URL.Path)
+		http.Error(w, "Authentication required", http.StatusForbidden)
+		return nil, identity{}, "", false
+	}
+	return cfg, id, recordingDir(cfg, id.user), true
+}
+
+// POST /recordings/start?channel=<频道>
+func (p *Proxy) recordStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, id, dir, ok := p.recordingContext(w, r)
+	if !ok {
+		return
+	}
+	channel := r.URL.Query().Get("channel")
+	if channel == "" {
+		http.Error(w, "Missing parameters", http.StatusBadRequest)
+		return
+	}
+	ch, ok := cfg.Channels[channel]
+	if !ok {
+		http.Error(w, "Unknown channel", http.StatusNotFound)
+		return
+	}
+	if !cfg.CanWatch(id.user, ch) {
+		http.Error(w, "Channel not allowed", http.StatusForbidden)
+		return
+	}
+	if !p.checkParental(w, r, cfg, id.user, ch) {
+		return
+	}
+	// HLS 按分片录制；DASH 暂不支持
+	if isDASH(ch.Path, "") {
+		http.Error(w, "Recording not supported for DASH channels", http.StatusUnprocessableEntity)
+		return
+	}
+	// 仅限试看的用户不能录制完整节目
+	if _, preview := cfg.PreviewFor(id.user, channel); preview {
+		http.Error(w, "Recording not allowed in preview", http.StatusForbidden)
+		return
+	}
+	if p.rejectStandby(w) || p.rejectMaintenance(w, cfg) {
+		return
+	}
+	if !cfg.InSchedule(id.user, time.Now()) {
+		http.Error(w, "Outside allowed hours", http.StatusForbidden)
+		return
+	}
+	// 录制下载的字节同样计入流量配额
+	var data *dataQuota
+	if limit := cfg.QuotaFor(id.user); limit > 0 {
+		key := quotaKey(cfg.TenantName(), id.user)
+		data = &dataQuota{used: p.quota.counter(key), remote: p.quota.remoteCounter(key), limit: limit}
+		if data.exceeded() {
+			http.Error(w, "Data quota exceeded", http.StatusForbidden)
+			return
+		}
+	}
+	if ok, reason := p.pluginAuthorize(r.Context(), cfg, pluginEvent{Tenant: cfg.TenantName(), User: id.user, IP: id.ip, Channel: channel, Path: ch.Path}); !ok {
+		http.Error(w, "Forbidden: "+cmp.Or(reason, "denied by plugin"), http.StatusForbidden)
+		return
+	}
+	rc := cfg.Recording
+	quota := cfg.RecordQuotaFor(id.user)
+	usage := p.recorder.usageOf(dir)
+	if usage.Load() >= quota {
+		http.Error(w, "Recording quota exceeded", http.StatusInsufficientStorage)
+		return
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Printf("[StreamProxy] 创建录制目录失败: %v", err)
+		http.Error(w, "Recording storage unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	a := &activeRecording{
+		meta:   Recording{ID: newRecordingID(), Channel: channel, Start: time.Now(), Status: recRecording},
+		dir:    dir,
+		owner:  dir,
+		cancel: cancel,
+	}
+	if err := p.recorder.add(a, rc.Active()); err != nil {
+		cancel(nil)
+		if errors.Is(err, errRecTooMany) {
+			http.Error(w, "Too many active recordings", http.StatusTooManyRequests)
+		} else {
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	if err := writeRecordingMeta(dir, a.meta); err != nil {
+		cancel(nil)
+		p.recorder.remove(a.meta.ID)
+		p.recorder.wg.Done()
+		log.Printf("[StreamProxy] 写入录制元数据失败: %v", err)
+		http.Error(w, "Recording storage unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	src := baseUpstreamURL(cfg, ch.Path)
+	go p.runRecording(ctx, cfg, a, src, usage, quota, data, rc.MaxDuration())
+	log.Printf("[StreamProxy] 开始录制: user=%s channel=%s id=%s", id.user, channel, a.meta.ID)
+	w.WriteHeader(http.StatusCreated)
+	writeJSONResponse(w, a.meta)
+}
+
+func (p *Proxy) runRecording(ctx context.Context, cfg *config.Config, a *activeRecording, src string, usage *atomic.Int64, quota int64, data *dataQuota, maxDur time.Duration) {
+	defer p.recorder.wg.Done()
+	t := time.AfterFunc(maxDur, func() { a.cancel(errRecMaxLength) })
+	defer t.Stop()
+
+	err := p.recordTo(ctx, cfg, a, src, usage, quota, data)
+	cause := context.Cause(ctx)
+	a.cancel(nil)
+
+	m := a.meta
+	end := time.Now()
+	m.End, m.Bytes = &end, a.written.Load()
+	switch {
+	case errors.Is(err, errRecQuota):
+		m.Status = recQuotaExceeded
+	case errors.Is(err, errQuotaExceeded):
+		m.Status, m.Error = recQuotaExceeded, err.Error()
+	case errors.Is(cause, errRecStopped):
+		m.Status = recStopped
+	case errors.Is(cause, errRecMaxLength):
+		m.Status = recCompleted
+	case errors.Is(cause, errShutdown):
+		m.Status = recInterrupted
+	case err == nil || errors.Is(err, io.EOF):
+		m.Status = recCompleted
+	default:
+		m.Status, m.Error = recFailed, err.Error()
+	}
+	if err := writeRecordingMeta(a.dir, m); err != nil {
+		log.Printf("[StreamProxy] 写入录制元数据失败: %v", err)
+	}
+	p.recorder.remove(m.ID)
+	log.Printf("[StreamProxy] 录制结束: id=%s status=%s bytes=%d", m.ID, m.Status, m.Bytes)
+}
+
+// 录制使用的流量配额；录制无法降速跟上直播，超出后无论 action 均停止录制
+type dataQuota struct {
+	used, remote *atomic.Int64
+	limit        int64
+}
+
+func (d *dataQuota) exceeded() bool {
+	return d.used.Load()+d.remote.Load() >= d.limit
+}
+
+func (p *Proxy) recordTo(ctx context.Context, cfg *config.Config, a *activeRecording, src string, usage *atomic.Int64, quota int64, data *dataQuota) error {
+	f, err := os.OpenFile(filepath.Join(a.dir, a.meta.ID+".ts"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out := &recWriter{f: f, a: a, usage: usage, quota: quota, data: data}
+	if isPlaylist(src, "") {
+		return p.recordHLS(ctx, cfg, src, out)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "*/*")
+	resp, err := p.upstreamDo(cfg, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("upstream status %d", resp.StatusCode)
+	}
+	return out.copyFrom(resp.Body)
+}
+
+// 写入录制文件并计入录制配额与流量配额
+type recWriter struct {
+	f     *os.File
+	a     *activeRecording
+	usage *atomic.Int64
+	quota int64
+	data  *dataQuota
+}
+
+// 读到 EOF 或出错为止，返回读取端的错误（含 io.EOF）
+func (w *recWriter) copyFrom(r io.Reader) error {
+	buf := make([]byte, relayChunk)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			if w.usage.Load()+int64(n) > w.quota {
+				return errRecQuota
+			}
+			if w.data != nil && w.data.exceeded() {
+				return errQuotaExceeded
+			}
+			if _, err := w.f.Write(buf[:n]); err != nil {
+				return err
+			}
+			w.usage.Add(int64(n))
+			w.a.written.Add(int64(n))
+			if w.data != nil {
+				w.data.used.Add(int64(n))
+			}
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// HLS 频道：选最高码率档位，轮询媒体清单并按序号依次追加新分片。
+// 直播从最新分片开始录；点播（#EXT-X-ENDLIST）录完全部分片后结束
+func (p *Proxy) recordHLS(ctx context.Context, cfg *config.Config, src string, out *recWriter) error {
+	media, pl, err := p.hlsMedia(ctx, cfg, src, highestVariant)
+	if err != nil {
+		return err
+	}
+	next := int64(-1)
+	for {
+		if pl.init != "" {
+			return errors.New("fMP4 HLS recording not supported")
+		}
+		n := int64(len(pl.segments))
+		switch {
+		case next < 0 && !pl.ended:
+			next = pl.seq + max(n-1, 0)
+		case next < pl.seq || next > pl.seq+n:
+			// 首次点播、落后于滑动窗口或上游序号重置
+			next = pl.seq
+		}
+		for ; next < pl.seq+n; next++ {
+			body, err := p.fetchUpstream(ctx, cfg, pl.segments[next-pl.seq])
+			if err != nil {
+				return err
+			}
+			err = out.copyFrom(body)
+			body.Close()
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+		}
+		if pl.ended {
+			return nil
+		}
+		wait := max(pl.target/2, time.Second)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if pl, err = p.fetchHLS(ctx, cfg, media); err != nil {
+			return err
+		}
+	}
+}
+
+// POST /recordings/stop?id=<录制ID>
+func (p *Proxy) recordStopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, _, dir, ok := p.recordingContext(w, r)
+	if !ok {
+		return
+	}
+	recID := r.URL.Query().Get("id")
+	for _, a := range p.recorder.activeFor(dir) {
+		if a.meta.ID == recID {
+			a.cancel(errRecStopped)
+			writeJSONResponse(w, map[string]string{"id": recID, "status": recStopped})
+			return
+		}
+	}
+	http.Error(w, "Recording not active", http.StatusNotFound)
+}
+
+// GET /recordings：当前用户的录制列表（新的在前）与配额
+func (p *Proxy) recordListHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, id, dir, ok := p.recordingContext(w, r)
+	if !ok {
+		return
+	}
+	active := map[string]*activeRecording{}
+	for _, a := range p.recorder.activeFor(dir) {
+		active[a.meta.ID] = a
+	}
+	list := []Recording{}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		recID, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !recIDPattern.MatchString(recID) {
+			continue
+		}
+		m, err := readRecordingMeta(dir, recID)
+		if err != nil {
+			continue
+		}
+		if a := active[recID]; a != nil {
+			m.Bytes = a.written.Load()
+		} else if m.Status == recRecording {
+			// 进程异常退出时留下的记录
+			m.Status = recInterrupted
+		}
+		list = append(list, m)
+	}
+	slices.SortFunc(list, func(a, b Recording) int { return b.Start.Compare(a.Start) })
+	writeJSONResponse(w, map[string]any{
+		"recordings":  list,
+		"quota_bytes": cfg.RecordQuotaFor(id.user),
+		"used_bytes":  p.recorder.usageOf(dir).Load(),
+	})
+}
+
+// GET /recordings/download?id=<录制ID>，支持 Range；录制中也可下载已写入的部分
+func (p *Proxy) recordDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	_, _, dir, ok := p.recordingContext(w, r)
+	if !ok {
+		return
+	}
+	recID := r.URL.Query().Get("id")
+	if !recIDPattern.MatchString(recID) {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		return
+	}
+	m, err := readRecordingMeta(dir, recID)
+	if err != nil {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(filepath.Join(dir, recID+".ts"))
+	if err != nil {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.ts"`, fsName(m.Channel), recID))
+	http.ServeContent(w, r, "", m.Start, f)
+}
+
+// POST /recordings/delete?id=<录制ID>；录制中的需先停止
+func (p *Proxy) recordDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, _, dir, ok := p.recordingContext(w, r)
+	if !ok {
+		return
+	}
+	recID := r.URL.Query().Get("id")
+	if !recIDPattern.MatchString(recID) {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		return
+	}
+	for _, a := range p.recorder.activeFor(dir) {
+		if a.meta.ID == recID {
+			http.Error(w, "Recording in progress", http.StatusConflict)
+			return
+		}
+	}
+	usage := p.recorder.usageOf(dir)
+	ts := filepath.Join(dir, recID+".ts")
+	if info, err := os.Stat(ts); err == nil {
+		if err := os.Remove(ts); err != nil {
+			http.Error(w, "Delete failed", http.StatusInternalServerError)
+			return
+		}
+		usage.Add(-info.Size())
+	}
+	if err := os.Remove(filepath.Join(dir, recID+".json")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "Delete failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, map[string]string{"id": recID, "status": "deleted"})
+}
+
+func writeJSONResponse(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+func TestRecordHLSChannel(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live/tv.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=500000\nlo/media.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2000000\nhi/media.m3u8\n"))
+	})
+	mux.HandleFunc("/live/hi/media.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:7\n#EXTINF:2,\nseg7.ts\n#EXTINF:2,\nseg8.ts\n#EXT-X-ENDLIST\n"))
+	})
+	mux.HandleFunc("/live/hi/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[" + filepath.Base(r.URL.Path) + "]"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := &config.Config{StreamHost: srv.URL}
+	cfg.Normalize()
+	p := New(config.Static(cfg))
+	a := &activeRecording{meta: Recording{ID: "r1"}, dir: t.TempDir()}
+	var usage atomic.Int64
+	src := baseUpstreamURL(cfg, "live/tv.m3u8")
+	if err := p.recordTo(context.Background(), cfg, a, src, &usage, 1<<20, nil); err != nil {
+		t.Fatalf("recordTo: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(a.dir, "r1.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[seg7.ts][seg8.ts]"; string(b) != want {
+		t.Errorf("recording = %q, want %q", b, want)
+	}
+	if got := a.written.Load(); got != int64(len(b)) {
+		t.Errorf("written = %d, want %d", got, len(b))
+	}
+}
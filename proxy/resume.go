@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errResumeExpired = errors.New("resume window expired")
+
+// 接管暂存上游时等待其读取协程停下的上限；超时则放弃暂存的上游
+const resumeHandoverTimeout = 2 * time.Second
+
+// 客户端断开后暂存的上游：后台持续读取到环形缓冲，窗口内同一用户重连同一上游时接管
+type parkedStream struct {
+	resp    *http.Response
+	cancel  context.CancelCauseFunc // 取消上游请求
+	timer   *time.Timer
+	stopped chan struct{}
+
+	mu    sync.Mutex
+	ring  byteRing
+	taken bool
+	err   error // 暂存期间上游读取出错
+}
+
+type resumePool struct {
+	mu     sync.Mutex
+	m      map[string]*parkedStream
+	closed bool
+}
+
+func newResumePool() *resumePool {
+	return &resumePool{m: map[string]*parkedStream{}}
+}
+
+// 暂存键：同一租户、同一用户、同一上游地址
+func resumeKeyFor(tenant, user, targetURL string) string {
+	return tenant + "\x00" + user + "\x00" + targetURL
+}
+
+// park 接管 resp 与其取消函数，window 内未被 take 则关闭上游
+func (rp *resumePool) park(key string, resp *http.Response, cancel context.CancelCauseFunc, window time.Duration, bufBytes int) {
+	ps := &parkedStream{resp: resp, cancel: cancel, stopped: make(chan struct{}), ring: newByteRing(bufBytes)}
+	rp.mu.Lock()
+	if rp.closed {
+		rp.mu.Unlock()
+		ps.close(errShutdown)
+		return
+	}
+	old := rp.m[key]
+	rp.m[key] = ps
+	ps.timer = time.AfterFunc(window, func() { rp.expire(key, ps) })
+	rp.mu.Unlock()
+	if old != nil {
+		old.timer.Stop()
+		old.close(errResumeExpired)
+	}
+	go ps.pump()
+}
+
+func (rp *resumePool) expire(key string, ps *parkedStream) {
+	rp.mu.Lock()
+	if rp.m[key] != ps {
+		rp.mu.Unlock()
+		return
+	}
+	delete(rp.m, key)
+	rp.mu.Unlock()
+	ps.close(errResumeExpired)
+}
+
+// take 取出暂存的上游及缓冲中从关键帧开始的数据；没有可用的暂存返回 nil
+func (rp *resumePool) take(ctx context.Context, key string) (*parkedStream, []byte) {
+	rp.mu.Lock()
+	ps := rp.m[key]
+	delete(rp.m, key)
+	rp.mu.Unlock()
+	if ps == nil {
+		return nil, nil
+	}
+	ps.timer.Stop()
+
+	ps.mu.Lock()
+	ps.taken = true
+	ps.mu.Unlock()
+	select {
+	case <-ps.stopped:
+	case <-time.After(resumeHandoverTimeout):
+		ps.close(errResumeExpired)
+		return nil, nil
+	case <-ctx.Done():
+		ps.close(context.Cause(ctx))
+		return nil, nil
+	}
+	if ps.err != nil {
+		ps.close(ps.err)
+		return nil, nil
+	}
+	buf := ps.ring.Bytes()
+	off := tsKeyframeOffset(buf)
+	if off < 0 {
+		off = tsSyncOffset(buf)
+	}
+	if off < 0 {
+		return ps, nil
+	}
+	return ps, buf[off:]
+}
+
+func (rp *resumePool) len() int {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return len(rp.m)
+}
+
+// 关闭所有暂存上游，之后的 park 直接关闭
+func (rp *resumePool) closeAll() {
+	rp.mu.Lock()
+	rp.closed = true
+	list := rp.m
+	rp.m = map[string]*parkedStream{}
+	rp.mu.Unlock()
+	for _, ps := range list {
+		ps.timer.Stop()
+		ps.close(errShutdown)
+	}
+}
+
+// 后台读取上游，直到被接管或出错
+func (ps *parkedStream) pump() {
+	defer close(ps.stopped)
+	b := make([]byte, relayChunk)
+	for {
+		n, err := ps.resp.Body.Read(b)
+		ps.mu.Lock()
+		ps.ring.Write(b[:n])
+		if err != nil {
+			ps.err = err
+		}
+		done := ps.taken || err != nil
+		ps.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+func (ps *parkedStream) close(cause error) {
+	ps.cancel(cause)
+	ps.resp.Body.Close()
+}
+
+// 定长环形缓冲，写满后覆盖最旧的数据
+type byteRing struct {
+	b     []byte
+	start int
+	n     int
+}
+
+func newByteRing(size int) byteRing {
+	return byteRing{b: make([]byte, size)}
+}
+
+func (r *byteRing) Write(p []byte) {
+	size := len(r.b)
+	if size == 0 {
+		return
+	}
+	if len(p) >= size {
+		copy(r.b, p[len(p)-size:])
+		r.start, r.n = 0, size
+		return
+	}
+	end := (r.start + r.n) % size
+	c := copy(r.b[end:], p)
+	copy(r.b, p[c:])
+	r.n += len(p)
+	if r.n > size {
+		r.start = (r.start + r.n - size) % size
+		r.n = size
+	}
+}
+
+// Bytes 按写入顺序返回缓冲内容的副本
+func (r *byteRing) Bytes() []byte {
+	out := make([]byte, 0, r.n)
+	end := r.start + r.n
+	if end <= len(r.b) {
+		return append(out, r.b[r.start:end]...)
+	}
+	out = append(out, r.b[r.start:]...)
+	return append(out, r.b[:end-len(r.b)]...)
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+var errOutsideSchedule = errors.New("outside allowed hours")
+
+const resultOutsideSchedule = "outside_schedule"
+
+// 周期检查活跃会话的访问时段，时段结束（或配置收紧）后断开
+func (p *Proxy) scheduleWatchdog(ctx context.Context) {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		cfg, now := p.src.Get(), time.Now()
+		for _, s := range p.sessions.list() {
+			tc := cfg
+			if s.tenant != "" {
+				if tc = cfg.Tenant(s.tenant); tc == nil {
+					continue // 由 watchConfig 处理
+				}
+			}
+			if !tc.InSchedule(s.user, now) {
+				log.Printf("[StreamProxy] 超出允许访问的时段，断开: user=%s channel=%s path=%s", s.user, s.channel, s.path)
+				s.cancel(errOutsideSchedule)
+			}
+		}
+	}
+}
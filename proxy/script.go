@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	scriptCheckInterval = 2 * time.Second        // 脚本文件变更检查间隔
+	scriptTimeout       = 100 * time.Millisecond // 单次 Lua 脚本执行上限
+)
+
+// 传给脚本的数据
+type scriptData struct {
+	Tenant  string
+	User    string
+	Pass    string // 仅 auth 脚本
+	IP      string
+	Path    string
+	Channel string
+	URL     string // 上游地址（rewrite_url / headers）
+	Query   url.Values
+	Header  http.Header // 客户端请求头
+}
+
+type loadedScript struct {
+	lua     *lua.FunctionProto
+	err     error
+	mtime   time.Time
+	checked time.Time
+}
+
+// 按文件路径缓存编译后的脚本，mtime 变化时重新编译
+type scriptCache struct {
+	mu sync.Mutex
+	m  map[string]*loadedScript
+}
+
+func newScriptCache() *scriptCache {
+	return &scriptCache{m: map[string]*loadedScript{}}
+}
+
+func (s *loadedScript) ok() bool { return s != nil && s.lua != nil }
+
+func (c *scriptCache) load(path string) (*loadedScript, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.m[path]
+	now := time.Now()
+	if s != nil && now.Sub(s.checked) < scriptCheckInterval {
+		return s, s.err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		// 文件暂时不可用时沿用上次成功加载的版本
+		if s.ok() {
+			s.checked = now
+			return s, nil
+		}
+		return nil, err
+	}
+	if s != nil && fi.ModTime().Equal(s.mtime) {
+		s.checked = now
+		return s, s.err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ns := &loadedScript{mtime: fi.ModTime(), checked: now}
+	ns.lua, ns.err = compileLua(b, filepath.Base(path))
+	if ns.err != nil {
+		log.Printf("[StreamProxy] 脚本解析失败: %s: %v", path, ns.err)
+		if s.ok() {
+			// 保留旧版本继续运行
+			s.mtime, s.checked = fi.ModTime(), now
+			return s, nil
+		}
+	} else {
+		log.Printf("[StreamProxy] 脚本已加载: %s", path)
+	}
+	c.m[path] = ns
+	return ns, ns.err
+}
+
+func compileLua(src []byte, path string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(bytes.NewReader(src), path)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, path)
+}
+
+// 执行脚本并返回其返回值；path 为空表示未配置，返回 nil
+func (p *Proxy) runScript(path string, data scriptData) (lua.LValue, error) {
+	if path == "" {
+		return lua.LNil, nil
+	}
+	s, err := p.scripts.load(path)
+	if err != nil {
+		return lua.LNil, err
+	}
+	return runLua(s.lua, data)
+}
+
+// 每次执行使用新的 Lua 状态，脚本之间不共享全局变量；只开放 base/string/table/math，
+// 不能读写文件或执行命令
+func runLua(proto *lua.FunctionProto, data scriptData) (lua.LValue, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true, CallStackSize: 64})
+	defer L.Close()
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{{lua.BaseLibName, lua.OpenBase}, {lua.StringLibName, lua.OpenString}, {lua.TabLibName, lua.OpenTable}, {lua.MathLibName, lua.OpenMath}} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		var parts []string
+		for i := 1; i <= L.GetTop(); i++ {
+			parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+		}
+		log.Printf("[StreamProxy] 脚本输出: %s", strings.Join(parts, " "))
+		return 0
+	}))
+	L.SetGlobal("url_escape", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(url.QueryEscape(L.CheckString(1))))
+		return 1
+	}))
+	L.SetGlobal("req", luaRequest(L, data))
+
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return lua.LNil, fmt.Errorf("script timed out after %s", scriptTimeout)
+		}
+		return lua.LNil, err
+	}
+	return L.Get(-1), nil
+}
+
+// 请求数据：req.user、req.query["token"]、req.header["User-Agent"] 等（多值取第一个）
+func luaRequest(L *lua.LState, data scriptData) *lua.LTable {
+	t := L.NewTable()
+	for k, v := range map[string]string{
+		"tenant": data.Tenant, "user": data.User, "pass": data.Pass, "ip": data.IP,
+		"path": data.Path, "channel": data.Channel, "url": data.URL,
+	} {
+		t.RawSetString(k, lua.LString(v))
+	}
+	q := L.NewTable()
+	for k, v := range data.Query {
+		if len(v) > 0 {
+			q.RawSetString(k, lua.LString(v[0]))
+		}
+	}
+	t.RawSetString("query", q)
+	h := L.NewTable()
+	for k, v := range data.Header {
+		if len(v) > 0 {
+			h.RawSetString(k, lua.LString(v[0]))
+		}
+	}
+	t.RawSetString("header", h)
+	return t
+}
+
+// rewrite_url 脚本：返回新的上游 URL，nil 或空串表示不改写
+func scriptURL(v lua.LValue) (string, error) {
+	switch v := v.(type) {
+	case *lua.LNilType:
+		return "", nil
+	case lua.LString:
+		return strings.TrimSpace(string(v)), nil
+	}
+	return "", fmt.Errorf("rewrite_url must return a string, got %s", v.Type())
+}
+
+// auth 脚本：true / "allow" 放行，false / "deny" 拒绝，其它交给内置认证
+func (p *Proxy) scriptAuth(path string, data scriptData) (decided, allow bool) {
+	v, err := p.runScript(path, data)
+	if err != nil {
+		log.Printf("[StreamProxy] auth 脚本失败: %v", err)
+		return false, false
+	}
+	switch v {
+	case lua.LTrue, lua.LString("allow"):
+		return true, true
+	case lua.LFalse, lua.LString("deny"):
+		return true, false
+	}
+	return false, false
+}
+
+// headers 脚本：返回表 {Name = "value"}，值为 false 时删除该头。
+// 名称须为合法的头字段名、值不能含控制字符（防止由请求参数带入换行伪造其它头）；
+// 任一项不合法时整张表都不应用
+func applyScriptHeaders(h http.Header, v lua.LValue) error {
+	if v == lua.LNil {
+		return nil
+	}
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("headers must return a table, got %s", v.Type())
+	}
+	set := http.Header{}
+	var del []string
+	var err error
+	t.ForEach(func(k, val lua.LValue) {
+		if err != nil {
+			return
+		}
+		name, ok := k.(lua.LString)
+		if !ok || !validHeaderName(string(name)) {
+			err = fmt.Errorf("invalid header name %q", k.String())
+			return
+		}
+		switch val := val.(type) {
+		case lua.LBool:
+			if !val {
+				del = append(del, string(name))
+			}
+		case lua.LString, lua.LNumber:
+			if !validHeaderValue(val.String()) {
+				err = fmt.Errorf("header %s: value contains control characters", name)
+				return
+			}
+			set.Set(string(name), val.String())
+		default:
+			err = fmt.Errorf("header %s: unsupported value type %s", name, val.Type())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range del {
+		h.Del(name)
+	}
+	for name, vs := range set {
+		h[name] = vs
+	}
+	return nil
+}
+
+// RFC 9110 token
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0 {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func validHeaderValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
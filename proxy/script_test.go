@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func runTestScript(t *testing.T, src string, data scriptData) (http.Header, error) {
+	t.Helper()
+	proto, err := compileLua([]byte(src), "test.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := runLua(proto, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.Header{"Authorization": {"Bearer keep"}, "X-Old": {"1"}}
+	return h, applyScriptHeaders(h, v)
+}
+
+func TestScriptHeaders(t *testing.T) {
+	h, err := runTestScript(t, `return {["X-User"] = req.user, ["X-Old"] = false, ["X-N"] = 5}`, scriptData{User: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("X-User") != "bob" || h.Get("X-N") != "5" || h.Get("X-Old") != "" || h.Get("Authorization") != "Bearer keep" {
+		t.Errorf("headers = %v", h)
+	}
+}
+
+func TestScriptHeadersRejectInjection(t *testing.T) {
+	for _, src := range []string{
+		`return {["X-Token"] = req.query["t"]}`,
+		`return {[req.query["t"]] = "1"}`,
+		`return {["X-Bad Name"] = "1"}`,
+	} {
+		data := scriptData{Query: url.Values{"t": {"abc\r\nAuthorization: evil"}}}
+		h, err := runTestScript(t, src, data)
+		if err == nil {
+			t.Errorf("%s: want error", src)
+		}
+		if h.Get("Authorization") != "Bearer keep" || h.Get("X-Token") != "" || h.Get("X-Old") != "1" {
+			t.Errorf("%s: headers changed: %v", src, h)
+		}
+	}
+}
+
+func TestScriptURL(t *testing.T) {
+	proto, err := compileLua([]byte(`if req.path == "old.ts" then return " http://o/new.ts " end`), "url.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{"old.ts": "http://o/new.ts", "x.ts": ""} {
+		v, err := runLua(proto, scriptData{Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := scriptURL(v); err != nil || got != want {
+			t.Errorf("scriptURL(%s) = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	proto, _ = compileLua([]byte(`return 42`), "url.lua")
+	v, _ := runLua(proto, scriptData{})
+	if _, err := scriptURL(v); err == nil {
+		t.Error("scriptURL accepted a number")
+	}
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+var (
+	errUpstreamIdle    = errors.New("upstream idle")
+	errKicked          = errors.New("kicked by admin")
+	errUpstreamRemoved = errors.New("upstream removed from config")
+	errShutdown        = errors.New("proxy shutting down")
+	errTenantRemoved   = errors.New("tenant removed from config")
+	errAccessRevoked   = errors.New("channel access revoked")
+	errMaxDuration     = errors.New("session duration limit reached")
+)
+
+// 活跃会话
+type session struct {
+	id           uint64
+	tenant       string // 默认租户为空
+	user         string
+	ip           string // 真实客户端 IP（已按 trusted_proxies 解析）
+	channel      string
+	path         string
+	streamHost   string // 建立时的上游地址，配置变更后据此判断是否需要断开
+	statsChannel string // 观看统计归属的频道
+	start        time.Time
+	cancel       context.CancelCauseFunc
+
+	upBytes   atomic.Int64 // 从上游读到的字节
+	readSince atomic.Int64 // 当前挂起中的上游读取开始时间（UnixNano），0 = 未在读
+}
+
+// SessionInfo 活跃会话快照，供管理接口使用
+type SessionInfo struct {
+	ID            uint64    `json:"id"`
+	Tenant        string    `json:"tenant,omitempty"`
+	User          string    `json:"user"`
+	IP            string    `json:"ip"`
+	Channel       string    `json:"channel,omitempty"`
+	Path          string    `json:"path"`
+	Start         time.Time `json:"start"`
+	UpstreamBytes int64     `json:"upstream_bytes"`
+}
+
+type sessionRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	m      map[uint64]*session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{m: map[uint64]*session{}}
+}
+
+// add 登记会话；tenantLimit > 0 时同租户会话数已达上限则拒绝
+// remote 为集群中其它节点上同一租户的会话数，计入租户上限
+func (r *sessionRegistry) add(s *session, tenantLimit, remote int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if tenantLimit > 0 {
+		n := remote
+		for _, o := range r.m {
+			if o.tenant == s.tenant {
+				n++
+			}
+		}
+		if n >= tenantLimit {
+			return false
+		}
+	}
+	r.nextID++
+	s.id = r.nextID
+	r.m[s.id] = s
+	return true
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.mu.Lock()
+	delete(r.m, s.id)
+	r.mu.Unlock()
+}
+
+func (r *sessionRegistry) list() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]*session, 0, len(r.m))
+	for _, s := range r.m {
+		out = append(out, s)
+	}
+	return out
+}
+
+// Sessions 返回当前活跃会话
+func (p *Proxy) Sessions() []SessionInfo {
+	list := p.sessions.list()
+	out := make([]SessionInfo, 0, len(list))
+	for _, s := range list {
+		out = append(out, SessionInfo{
+			ID: s.id, Tenant: s.tenant, User: s.user, IP: s.ip, Channel: s.channel, Path: s.path,
+			Start: s.start, UpstreamBytes: s.upBytes.Load(),
+		})
+	}
+	return out
+}
+
+// Kick 断开指定会话；id 为 0 时按 user 断开该用户全部会话。
+// 租户用户写作 "租户/用户名"。返回断开数量
+func (p *Proxy) Kick(id uint64, user string) int {
+	n := 0
+	for _, s := range p.sessions.list() {
+		if (id != 0 && s.id == id) || (id == 0 && user != "" && s.qualifiedUser() == user) {
+			s.cancel(errKicked)
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("[StreamProxy] 管理端断开会话: id=%d user=%s count=%d", id, user, n)
+	}
+	return n
+}
+
+// 带租户命名空间的用户名
+func (s *session) qualifiedUser() string {
+	if s.tenant == "" {
+		return s.user
+	}
+	return s.tenant + "/" + s.user
+}
+
+func (p *Proxy) cancelAll(cause error) {
+	for _, s := range p.sessions.list() {
+		s.cancel(cause)
+	}
+}
+
+// 包装上游 Body：统计字节并记录读取挂起时间
+func (p *Proxy) wrapBody(s *session, body io.ReadCloser) io.ReadCloser {
+	return &sessionReader{ReadCloser: body, s: s, m: &p.metrics}
+}
+
+type sessionReader struct {
+	io.ReadCloser
+	s *session
+	m *metrics
+}
+
+func (r *sessionReader) Read(b []byte) (int, error) {
+	r.s.readSince.Store(time.Now().UnixNano())
+	n, err := r.ReadCloser.Read(b)
+	r.s.readSince.Store(0)
+	if n > 0 {
+		r.s.upBytes.Add(int64(n))
+		r.m.upstreamBytes.Add(int64(n))
+	}
+	return n, err
+}
+
+// 周期巡检，取消上游长时间无数据的会话
+func (p *Proxy) idleWatchdog(ctx context.Context) {
+	for {
+		ic := p.src.Get().Idle
+		interval := time.Duration(ic.CheckIntervalSec) * time.Second
+		if interval <= 0 {
+			interval = 5 * time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if ic.TimeoutSec <= 0 {
+			continue
+		}
+		limit := time.Duration(ic.TimeoutSec) * time.Second
+		now := time.Now()
+		for _, s := range p.sessions.list() {
+			since := s.readSince.Load()
+			if since != 0 && now.Sub(time.Unix(0, since)) > limit {
+				log.Printf("[StreamProxy] 上游 %s 无数据，判定为空闲流: user=%s ip=%s path=%s bytes=%d", limit, s.user, s.ip, s.path, s.upBytes.Load())
+				s.cancel(errUpstreamIdle)
+			}
+		}
+	}
+}
+
+// 配置变化时断开上游已被移除的会话：频道被删除/改指向，或 stream_host 变更
+func (p *Proxy) watchConfig(ctx context.Context) {
+	t := time.NewTicker(2 * time.Second)
+	defer t.Stop()
+	last := p.src.Get()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		cfg := p.src.Get()
+		if cfg == last {
+			continue
+		}
+		last = cfg
+		p.reconcileSessions(cfg)
+	}
+}
+
+// 按新配置检查所有活跃会话
+func (p *Proxy) reconcileSessions(cfg *config.Config) {
+	for _, s := range p.sessions.list() {
+		tc := cfg
+		if s.tenant != "" {
+			tc = cfg.Tenant(s.tenant)
+		}
+		if tc == nil {
+			log.Printf("[StreamProxy] 租户已从配置移除，断开: tenant=%s user=%s", s.tenant, s.user)
+			s.cancel(errTenantRemoved)
+			continue
+		}
+		// 内置测试源不在 channels 中，也不访问上游
+		if s.channel == testPatternChannel {
+			continue
+		}
+		removed := s.streamHost != tc.StreamHost
+		if s.channel != "" {
+			ch, ok := tc.Channels[s.channel]
+			removed = removed || !ok || ch.Path != s.path
+		}
+		if removed {
+			log.Printf("[StreamProxy] 上游已从配置移除，断开: user=%s channel=%s path=%s", s.user, s.channel, s.path)
+			s.cancel(errUpstreamRemoved)
+			continue
+		}
+		if ch, ok := tc.Channels[s.channel]; (ok && !tc.CanWatch(s.user, ch)) || (s.channel == "" && !tc.CanWatchPath(s.user, s.path)) {
+			log.Printf("[StreamProxy] 频道访问权限已撤销，断开: user=%s channel=%s path=%s", s.user, s.channel, s.path)
+			s.cancel(errAccessRevoked)
+		}
+	}
+}
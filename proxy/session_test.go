@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+func TestReconcileKeepsTestPattern(t *testing.T) {
+	cfg := &config.Config{StreamHost: "http://a:8080", Channels: map[string]config.ChannelCfg{"news": {Path: "live/news.ts"}}}
+	cfg.Normalize()
+	p := New(config.Static(cfg))
+
+	add := func(channel, path string) context.Context {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		s := &session{user: "bob", channel: channel, path: path, streamHost: cfg.StreamHost, cancel: cancel}
+		if !p.sessions.add(s, 0, 0) {
+			t.Fatal("add session failed")
+		}
+		return ctx
+	}
+	tp := add(testPatternChannel, "")
+	news := add("news", "live/news.ts")
+
+	// 重新加载：换上游并删除 news 频道
+	next := &config.Config{StreamHost: "http://b:8080", Channels: map[string]config.ChannelCfg{}}
+	next.Normalize()
+	p.reconcileSessions(next)
+
+	if err := context.Cause(tp); err != nil {
+		t.Errorf("test pattern session cancelled: %v", err)
+	}
+	if err := context.Cause(news); !errors.Is(err, errUpstreamRemoved) {
+		t.Errorf("news session cause = %v, want %v", err, errUpstreamRemoved)
+	}
+}
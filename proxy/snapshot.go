@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+var errSnapshotBusy = errors.New("too many snapshots in progress")
+
+// 频道截图缓存：同一频道并发请求只截一次，失败时返回旧图
+type snapshotCache struct {
+	mu      sync.Mutex
+	m       map[string]*snapshotEntry
+	running int
+}
+
+type snapshotEntry struct {
+	img      []byte
+	at       time.Time
+	err      error
+	inflight chan struct{} // 截图进行中
+}
+
+func newSnapshotCache() *snapshotCache {
+	return &snapshotCache{m: map[string]*snapshotEntry{}}
+}
+
+func (c *snapshotCache) get(key string, sc config.SnapshotCfg, gen func() ([]byte, error)) ([]byte, time.Time, error) {
+	c.mu.Lock()
+	e := c.m[key]
+	if e == nil {
+		e = &snapshotEntry{}
+		c.m[key] = e
+	}
+	if e.img != nil && time.Since(e.at) < sc.TTL() {
+		c.mu.Unlock()
+		return e.img, e.at, nil
+	}
+	if wait := e.inflight; wait != nil {
+		c.mu.Unlock()
+		<-wait
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if e.img != nil {
+			return e.img, e.at, nil
+		}
+		return nil, time.Time{}, e.err
+	}
+	if c.running >= sc.Workers() {
+		defer c.mu.Unlock()
+		if e.img != nil {
+			return e.img, e.at, nil
+		}
+		return nil, time.Time{}, errSnapshotBusy
+	}
+	c.running++
+	done := make(chan struct{})
+	e.inflight = done
+	c.mu.Unlock()
+
+	img, err := gen()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running--
+	e.inflight, e.err = nil, err
+	close(done)
+	if err == nil {
+		e.img, e.at = img, time.Now()
+	} else if e.img != nil {
+		log.Printf("[StreamProxy] 截图失败，返回旧图: %v", err)
+		return e.img, e.at, nil
+	}
+	return e.img, e.at, err
+}
+
+// GET /snapshot?channel=<频道>：返回频道最近一帧 JPEG
+func (p *Proxy) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := p.config(r.Context())
+	if cfg == nil {
+		http.Error(w, "Unknown tenant", http.StatusNotFound)
+		return
+	}
+	id, ok := identityFrom(r.Context())
+	if !ok {
+		log.Printf("[StreamProxy] 路由 %s 未配置 auth 中间件，拒绝请求", r.URL.Path)
+		http.Error(w, "Authentication required", http.StatusForbidden)
+		return
+	}
+	channel := r.URL.Query().Get("channel")
+	if channel == "" {
+		http.Error(w, "Missing parameters", http.StatusBadRequest)
+		return
+	}
+	ch, ok := cfg.Channels[channel]
+	if !ok {
+		http.Error(w, "Unknown channel", http.StatusNotFound)
+		return
+	}
+	if !cfg.CanWatch(id.user, ch) {
+		http.Error(w, "Channel not allowed", http.StatusForbidden)
+		return
+	}
+	if !p.checkParental(w, r, cfg, id.user, ch) {
+		return
+	}
+	if ok, reason := p.pluginAuthorize(r.Context(), cfg, pluginEvent{Tenant: cfg.TenantName(), User: id.user, IP: id.ip, Channel: channel, Path: ch.Path}); !ok {
+		http.Error(w, "Forbidden: "+cmp.Or(reason, "denied by plugin"), http.StatusForbidden)
+		return
+	}
+
+	src := baseUpstreamURL(cfg, ch.Path)
+	sc := cfg.Snapshot
+	img, at, err := p.snapshots.get(cfg.TenantName()+"\x00"+channel, sc, func() ([]byte, error) {
+		return p.captureFrame(cfg, src, sc)
+	})
+	switch {
+	case errors.Is(err, errSnapshotBusy):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Snapshot busy", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		log.Printf("[StreamProxy] 截图失败: channel=%s err=%v", channel, err)
+		http.Error(w, "Snapshot failed", http.StatusBadGateway)
+		return
+	}
+	maxAge := max(0, int((sc.TTL() - time.Since(at)).Seconds()))
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(img)))
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(maxAge))
+	w.Header().Set("Last-Modified", at.UTC().Format(http.TimeFormat))
+	w.Write(img)
+}
+
+// 拉取上游并用 ffmpeg 截取第一帧；与发起请求的客户端解耦，等待中的其它请求不受其断开影响
+func (p *Proxy) captureFrame(cfg *config.Config, src string, sc config.SnapshotCfg) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sc.Timeout())
+	defer cancel()
+	var input io.Reader
+	if isPlaylist(src, "") {
+		// HLS 清单本身不是视频，取最新的一个分片（fMP4 时带上初始化段）交给 ffmpeg
+		init, seg, err := p.hlsLatestSegment(ctx, cfg, src)
+		if err != nil {
+			return nil, err
+		}
+		var parts []io.Reader
+		for _, u := range []string{init, seg} {
+			if u == "" {
+				continue
+			}
+			body, err := p.fetchUpstream(ctx, cfg, u)
+			if err != nil {
+				return nil, err
+			}
+			defer body.Close()
+			parts = append(parts, body)
+		}
+		input = io.MultiReader(parts...)
+	} else {
+		body, err := p.fetchUpstream(ctx, cfg, src)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		input = body
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0", "-frames:v", "1"}
+	if sc.Width > 0 {
+		args = append(args, "-vf", fmt.Sprintf("scale=%d:-2", sc.Width))
+	}
+	args = append(args, "-f", "image2", "-c:v", "mjpeg", "-q:v", "4", "pipe:1")
+	cmd := exec.CommandContext(ctx, cfg.FFmpegPath(), args...)
+	cmd.Stdin = input
+	var stderr tailBuffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, errors.New("ffmpeg produced no image")
+	}
+	return out, nil
+}
+
+func (p *Proxy) fetchUpstream(ctx context.Context, cfg *config.Config, u string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "*/*")
+	resp, err := p.upstreamDo(cfg, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream status %d: %s", resp.StatusCode, u)
+	}
+	return resp.Body, nil
+}
+
+// 最新分片地址；主清单选码率最低的档位（截图足够清晰且下载最快）
+func (p *Proxy) hlsLatestSegment(ctx context.Context, cfg *config.Config, src string) (init, seg string, err error) {
+	_, pl, err := p.hlsMedia(ctx, cfg, src, lowestVariant)
+	if err != nil {
+		return "", "", err
+	}
+	if len(pl.segments) == 0 {
+		return "", "", errors.New("playlist has no segments")
+	}
+	return pl.init, pl.segments[len(pl.segments)-1], nil
+}
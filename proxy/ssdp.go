@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+var ssdpGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// 开启 dlna 时在局域网宣告媒体服务器：定期广播 ssdp:alive，应答 M-SEARCH，关闭或退出时广播 ssdp:byebye
+func (p *Proxy) ssdpLoop(ctx context.Context) {
+	var s *ssdpServer
+	defer func() {
+		if s != nil {
+			s.close()
+		}
+	}()
+	for {
+		cfg := p.src.Get()
+		switch {
+		case cfg.DLNA.Enabled && s == nil:
+			var err error
+			if s, err = p.startSSDP(); err != nil {
+				log.Printf("[StreamProxy] DLNA 宣告启动失败: %v", err)
+			} else {
+				log.Printf("[StreamProxy] DLNA 宣告已启动: %s (uuid:%s)", cfg.DLNA.Name(), dlnaUUID(cfg))
+			}
+		case !cfg.DLNA.Enabled && s != nil:
+			s.close()
+			s = nil
+			log.Printf("[StreamProxy] DLNA 宣告已停止")
+		}
+		if s != nil && time.Since(s.lastNotify) >= cfg.DLNA.NotifyInterval() {
+			s.notify(cfg, "ssdp:alive")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// M-SEARCH 应答限速：同一来源每秒最多应答一次，全部来源每秒最多 ssdpMaxReplies 次
+const ssdpMaxReplies = 20
+
+type ssdpServer struct {
+	p          *Proxy
+	mc         *net.UDPConn // 组播监听，接收 M-SEARCH
+	uc         *net.UDPConn // 发送 NOTIFY 与单播应答
+	lastNotify time.Time
+	done       chan struct{}
+
+	// 仅由 serve 协程访问
+	window  time.Time
+	replies int
+	seen    map[string]time.Time
+}
+
+func (p *Proxy) startSSDP() (*ssdpServer, error) {
+	mc, err := net.ListenMulticastUDP("udp4", nil, ssdpGroup)
+	if err != nil {
+		return nil, err
+	}
+	uc, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		mc.Close()
+		return nil, err
+	}
+	s := &ssdpServer{p: p, mc: mc, uc: uc, done: make(chan struct{}), seen: map[string]time.Time{}}
+	go s.serve()
+	return s, nil
+}
+
+func (s *ssdpServer) close() {
+	s.notify(s.p.src.Get(), "ssdp:byebye")
+	s.mc.Close()
+	<-s.done
+	s.uc.Close()
+}
+
+// 宣告的类型：根设备、设备 UUID、设备类型与两个服务
+func ssdpTypes(uuid string) []string {
+	return []string{"upnp:rootdevice", "uuid:" + uuid, dlnaDeviceType, dlnaCDS, dlnaCMS}
+}
+
+func ssdpUSN(uuid, nt string) string {
+	if nt == "uuid:"+uuid {
+		return nt
+	}
+	return "uuid:" + uuid + "::" + nt
+}
+
+func ssdpMaxAge(cfg *config.Config) int {
+	return int(3 * cfg.DLNA.NotifyInterval() / time.Second)
+}
+
+func (s *ssdpServer) serverHeader() string {
+	return fmt.Sprintf("stream-proxy/%s UPnP/1.0 DLNADOC/1.50", s.p.build.Version)
+}
+
+// 设备描述地址；host 为面向对端的本机 IP（配置了 advertise_host 时以其为准）
+func ssdpLocation(cfg *config.Config, host string) string {
+	scheme := "http"
+	if cfg.Listen.TLS.Enabled() {
+		scheme = "https"
+	}
+	if cfg.DLNA.AdvertiseHost != "" {
+		host = cfg.DLNA.AdvertiseHost
+	}
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(cfg.Listen.Port)) + "/dlna/device.xml"
+}
+
+// 到达 to 时使用的本机地址（UDP "连接" 不发送数据）
+func localIPFor(to *net.UDPAddr) string {
+	c, err := net.DialUDP("udp4", nil, to)
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+func (s *ssdpServer) notify(cfg *config.Config, nts string) {
+	uuid := dlnaUUID(cfg)
+	loc := ssdpLocation(cfg, localIPFor(ssdpGroup))
+	for _, nt := range ssdpTypes(uuid) {
+		var b strings.Builder
+		b.WriteString("NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\n")
+		if nts == "ssdp:alive" {
+			fmt.Fprintf(&b, "CACHE-CONTROL: max-age=%d\r\nLOCATION: %s\r\nSERVER: %s\r\n", ssdpMaxAge(cfg), loc, s.serverHeader())
+		}
+		fmt.Fprintf(&b, "NT: %s\r\nNTS: %s\r\nUSN: %s\r\n\r\n", nt, nts, ssdpUSN(uuid, nt))
+		if _, err := s.uc.WriteToUDP([]byte(b.String()), ssdpGroup); err != nil {
+			log.Printf("[StreamProxy] DLNA 广播失败: %v", err)
+			return
+		}
+	}
+	s.lastNotify = time.Now()
+}
+
+// 来源地址是否位于本机某个接口的网段内（含回环）
+func onLink(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ssdpServer) allow(ip string) bool {
+	now := time.Now()
+	if now.Sub(s.window) >= time.Second {
+		s.window, s.replies = now, 0
+		for k, t := range s.seen {
+			if now.Sub(t) >= time.Second {
+				delete(s.seen, k)
+			}
+		}
+	}
+	if _, ok := s.seen[ip]; ok || s.replies >= ssdpMaxReplies {
+		return false
+	}
+	s.seen[ip] = now
+	s.replies++
+	return true
+}
+
+func (s *ssdpServer) serve() {
+	defer close(s.done)
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := s.mc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+			continue
+		}
+		cfg := s.p.src.Get()
+		// 只应答本机直连网段内的局域网来源，避免被伪造源地址的请求用作 UDP 反射放大
+		if !cfg.DLNAAllowed(from.IP.String()) || !onLink(from.IP) || !s.allow(from.IP.String()) {
+			continue
+		}
+		uuid := dlnaUUID(cfg)
+		st := req.Header.Get("ST")
+		var sts []string
+		for _, t := range ssdpTypes(uuid) {
+			if st == "ssdp:all" || st == t {
+				sts = append(sts, t)
+			}
+		}
+		if len(sts) == 0 {
+			continue
+		}
+		// 按 MX 随机延迟应答，避免同一时刻大量设备回包
+		mx, _ := strconv.Atoi(req.Header.Get("MX"))
+		delay := time.Duration(rand.Int64N(int64(min(max(mx, 1), 5)) * int64(time.Second)))
+		time.AfterFunc(delay, func() {
+			loc := ssdpLocation(cfg, localIPFor(from))
+			for _, t := range sts {
+				msg := fmt.Sprintf("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=%d\r\nDATE: %s\r\nEXT:\r\nLOCATION: %s\r\nSERVER: %s\r\nST: %s\r\nUSN: %s\r\n\r\n",
+					ssdpMaxAge(cfg), time.Now().UTC().Format(http.TimeFormat), loc, s.serverHeader(), t, ssdpUSN(uuid, t))
+				s.uc.WriteToUDP([]byte(msg), from)
+			}
+		})
+	}
+}
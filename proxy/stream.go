@@ -0,0 +1,479 @@
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"r9mc.com/stream-proxy/auth"
+	"r9mc.com/stream-proxy/config"
+)
+
+// 上游地址：stream_host + path，并按 query 策略追加客户端参数
+func upstreamURL(cfg *config.Config, path string, client *http.Request) string {
+	u := baseUpstreamURL(cfg, path)
+	if q := pathQuery(client); q != "" {
+		u += "?" + q
+	}
+	return appendPassthroughQuery(u, client.URL.Query(), cfg.Query)
+}
+
+// 按 path 请求时 path 参数自带的查询串（path=live/a.ts?token=...），不受 query 透传策略限制
+func pathQuery(client *http.Request) string {
+	q := client.URL.Query()
+	if q.Get("channel") != "" {
+		return ""
+	}
+	_, query := config.SplitPathQuery(q.Get("path"))
+	return query
+}
+
+// client 为客户端请求，其请求头按 request_headers 策略选择性透传
+func (p *Proxy) newUpstreamRequest(ctx context.Context, targetURL string, client *http.Request) (*http.Request, error) {
+	req, err := p.buildUpstreamRequest(ctx, targetURL, client)
+	if err != nil {
+		return nil, err
+	}
+	p.logForward(req, client)
+	return req, nil
+}
+
+func (p *Proxy) logForward(req, client *http.Request) {
+	var ip string
+	if cfg := p.config(client.Context()); cfg != nil {
+		ip = auth.ClientIP(client, cfg.TrustedProxyPrefixes())
+	}
+	log.Printf("[StreamProxy] Forwarding to: %s (client=%s)", req.URL, ip)
+}
+
+// 同 newUpstreamRequest，但不记录转发日志（缓存命中时不回源）
+func (p *Proxy) buildUpstreamRequest(ctx context.Context, targetURL string, client *http.Request) (*http.Request, error) {
+	cfg := p.config(client.Context())
+	if cfg == nil {
+		return nil, errTenantRemoved
+	}
+	data := scriptData{
+		Tenant:  cfg.TenantName(),
+		IP:      auth.ClientIP(client, cfg.TrustedProxyPrefixes()),
+		URL:     targetURL,
+		Path:    client.URL.Query().Get("path"),
+		Channel: client.URL.Query().Get("channel"),
+		Query:   client.URL.Query(),
+		Header:  client.Header,
+	}
+	if id, ok := identityFrom(client.Context()); ok {
+		data.User = id.user
+	}
+	if v, err := p.runScript(cfg.Scripts.RewriteURL, data); err != nil {
+		log.Printf("[StreamProxy] rewrite_url 脚本失败: %v", err)
+	} else if out, err := scriptURL(v); err != nil {
+		log.Printf("[StreamProxy] rewrite_url 脚本失败: %v", err)
+	} else if out != "" {
+		targetURL = out
+		data.URL = out
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("Connection", "keep-alive")
+	copyHeaders(req.Header, client.Header, cfg.RequestHeaders.Forward)
+	if v, err := p.runScript(cfg.Scripts.Headers, data); err != nil {
+		log.Printf("[StreamProxy] headers 脚本失败: %v", err)
+	} else if err := applyScriptHeaders(req.Header, v); err != nil {
+		log.Printf("[StreamProxy] headers 脚本失败: %v", err)
+	}
+	// 不透传客户端的 Accept-Encoding：由 Transport 自行请求 gzip 并透明解压，
+	// 清单过滤与缓存拿到的始终是明文，是否对客户端压缩由 gzip 中间件决定
+	req.Header.Del("Accept-Encoding")
+	return req, nil
+}
+
+// 试看归属的频道：按 path 播放时取该路径对应的频道，优先取设置了试看的那个
+func previewChannel(cfg *config.Config, user, channel, path string) string {
+	if channel != "" {
+		return channel
+	}
+	names := cfg.ChannelNamesForPath(path)
+	for _, n := range names {
+		if _, ok := cfg.PreviewFor(user, n); ok {
+			return n
+		}
+	}
+	if len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
+
+func (p *Proxy) streamHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := p.config(r.Context())
+	if cfg == nil {
+		http.Error(w, "Unknown tenant", http.StatusNotFound)
+		return
+	}
+
+	// 身份由 auth 中间件写入；路由链中缺少 auth 时拒绝服务而不是放行
+	id, ok := identityFrom(r.Context())
+	if !ok {
+		log.Printf("[StreamProxy] 路由 %s 未配置 auth 中间件，拒绝请求", r.URL.Path)
+		http.Error(w, "Authentication required", http.StatusForbidden)
+		return
+	}
+	user, ip := id.user, id.ip
+	path := r.URL.Query().Get("path")
+	channel := r.URL.Query().Get("channel")
+	if path == "" && channel == "" {
+		http.Error(w, "Missing parameters", http.StatusBadRequest)
+		return
+	}
+	var ch *config.ChannelCfg
+	if channel == testPatternChannel {
+		path = testPatternChannel
+	} else if channel != "" {
+		c, ok := cfg.Channels[channel]
+		if !ok {
+			http.Error(w, "Unknown channel", http.StatusNotFound)
+			return
+		}
+		ch, path = &c, c.Path
+	} else {
+		// 权限判断与上游地址使用同一个规范化后的路径，避免 %3F、//、./ 等写法绕过频道权限；
+		// 附带的查询串由 upstreamURL 另行拼接
+		raw, _ := config.SplitPathQuery(path)
+		_, esc, err := config.NormalizePath(raw)
+		if err != nil {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		path = esc
+	}
+	if (ch != nil && !cfg.CanWatch(user, *ch)) || (ch == nil && !cfg.CanWatchPath(user, path)) {
+		http.Error(w, "Channel not allowed", http.StatusForbidden)
+		return
+	}
+	pcs := cfg.ChannelsForPath(path)
+	if ch != nil {
+		pcs = []config.ChannelCfg{*ch}
+	}
+	if !p.checkParental(w, r, cfg, user, pcs...) {
+		return
+	}
+	if p.rejectStandby(w) || p.rejectMaintenance(w, cfg) {
+		return
+	}
+	if !cfg.InSchedule(user, time.Now()) {
+		http.Error(w, "Outside allowed hours", http.StatusForbidden)
+		return
+	}
+	qw, allowed := p.quotaWriter(r.Context(), w, cfg, user)
+	if !allowed {
+		http.Error(w, "Data quota exceeded", http.StatusForbidden)
+		return
+	}
+	w = qw
+
+	if ok, reason := p.pluginAuthorize(r.Context(), cfg, pluginEvent{Tenant: cfg.TenantName(), User: user, IP: ip, Channel: channel, Path: path}); !ok {
+		http.Error(w, "Forbidden: "+cmp.Or(reason, "denied by plugin"), http.StatusForbidden)
+		return
+	}
+
+	pvChannel := previewChannel(cfg, user, channel, path)
+	pv, preview := cfg.PreviewFor(user, pvChannel)
+	var previewLeft time.Duration
+	if preview {
+		// 按频道计时，同一频道的不同 path 写法共用试看时长与冷却
+		left, retry, ok := p.previews.allow(cfg.TenantName()+"\x00"+user+"\x00"+cmp.Or(pvChannel, path), pv)
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+			http.Error(w, cmp.Or(pv.Message, "Preview time used up"), http.StatusForbidden)
+			return
+		}
+		previewLeft = left
+	}
+
+	// 绕过主播放列表直接请求超出档位的变体
+	if v, ok := p.variants.lookup(upstreamURL(cfg, path, r)); ok {
+		if prof, limited := cfg.ABRProfileFor(user); limited && !prof.Allows(v.bandwidth, v.height) {
+			http.Error(w, "Variant not allowed", http.StatusForbidden)
+			return
+		}
+	}
+
+	if p.serveCached(w, r, cfg, path) {
+		return
+	}
+
+	if !p.admission.acquire(r.Context(), cfg.Admission) {
+		p.metrics.admissionRejected.Add(1)
+		w.Header().Set("Retry-After", strconv.Itoa(cfg.Admission.RetryAfter()))
+		http.Error(w, "Too many streams", http.StatusServiceUnavailable)
+		return
+	}
+	defer p.admission.release()
+
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	sess := &session{tenant: cfg.TenantName(), user: user, ip: ip, channel: channel, path: path, streamHost: cfg.StreamHost, start: time.Now(), cancel: cancel}
+	sess.statsChannel = channel
+	if channel == "" {
+		sess.statsChannel = cmp.Or(cfg.ChannelNameForPath(path), otherChannel)
+	}
+	if !p.sessions.add(sess, p.src.Get().Tenants[sess.tenant].MaxSessions, p.remoteSessions(sess.tenant)) {
+		w.Header().Set("Retry-After", strconv.Itoa(cfg.Admission.RetryAfter()))
+		http.Error(w, "Tenant session limit reached", http.StatusServiceUnavailable)
+		return
+	}
+	p.metrics.sessionsTotal.Add(1)
+	defer p.sessions.remove(sess)
+	p.channelStats.join(sess)
+	defer p.channelStats.leave(sess)
+	p.pluginNotify(cfg, sess.event(hookSessionStart))
+	result := resultOK
+	defer func() { p.endSession(cfg, sess, result) }()
+	if preview {
+		t := time.AfterFunc(previewLeft, func() { cancel(errPreviewEnded) })
+		defer t.Stop()
+		// 在 flushWriter 关闭之后执行
+		defer func() {
+			if errors.Is(context.Cause(ctx), errPreviewEnded) {
+				log.Printf("[StreamProxy] 试看结束: user=%s channel=%s path=%s", user, channel, path)
+				writeSlate(w, pv.Slate)
+			}
+		}()
+	}
+
+	if d := cfg.MaxSessionFor(user, pcs...); d > 0 {
+		t := time.AfterFunc(d, func() { cancel(errMaxDuration) })
+		defer t.Stop()
+		defer func() {
+			if !errors.Is(context.Cause(ctx), errMaxDuration) {
+				return
+			}
+			log.Printf("[StreamProxy] 会话达到时长上限 %s，断开: user=%s ip=%s path=%s", d, user, ip, path)
+			if cfg.SessionLimit.Reauth {
+				// 丢弃认证缓存，重连须重新走认证插件
+				p.authCache.forget(sess.tenant, user)
+			}
+		}()
+	}
+
+	if channel == testPatternChannel {
+		result = p.serveTestPattern(ctx, w, cfg, sess)
+		return
+	}
+	if ch != nil && ch.Transcode != "" {
+		result = p.serveTranscode(ctx, w, cfg, ch, sess)
+		return
+	}
+
+	target := upstreamURL(cfg, path, r)
+	bp := cfg.BackpressureFor(user, ch)
+	fb := cfg.FallbackFor(ch)
+	fallback := fb.Slate != "" && !isPlaylist(path, "") && !isDASH(path, "")
+	// 断线续播仅用于阻塞策略的连续流：其它策略在转发中会关闭或替换上游；备用画面同理
+	var resumeKey string
+	if cfg.Resume.WindowSec > 0 && bp.Policy == config.BackpressureBlock && !fallback && !isPlaylist(path, "") && !isDASH(path, "") {
+		resumeKey = resumeKeyFor(sess.tenant, user, target)
+	}
+
+	var (
+		resp     *http.Response
+		prefix   []byte
+		upCancel context.CancelCauseFunc
+		parked   bool
+		upErr    error // 启用备用画面时首次连接上游的错误，此时直接从 slate 开始
+	)
+	if resumeKey != "" {
+		if ps, buf := p.resume.take(ctx, resumeKey); ps != nil {
+			resp, prefix, upCancel = ps.resp, buf, ps.cancel
+			p.metrics.sessionsResumed.Add(1)
+			log.Printf("[StreamProxy] 客户端重连，接管暂存上游: user=%s path=%s", user, path)
+		}
+	}
+	if resp == nil {
+		upCtx := context.Context(ctx)
+		if resumeKey != "" {
+			// 上游请求不随客户端断开而取消，断开后可以暂存
+			upCtx = context.WithoutCancel(ctx)
+		}
+		upCtx, upCancel = context.WithCancelCause(upCtx)
+		req, err := p.newUpstreamRequest(upCtx, target, r)
+		if err != nil {
+			upCancel(nil)
+			result = resultUpstreamError
+			http.Error(w, "Bad upstream request", http.StatusBadGateway)
+			return
+		}
+		resp, err = p.upstreamDo(cfg, req)
+		if err != nil && fallback {
+			upErr = err
+			resp = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}
+		} else if err != nil {
+			upCancel(nil)
+			result = resultUpstreamError
+			http.Error(w, "Upstream error: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	defer func() {
+		if !parked {
+			upCancel(nil)
+			resp.Body.Close()
+		}
+	}()
+	if resumeKey != "" {
+		// 踢出、空闲超时等仍须取消上游；客户端断开（context.Canceled）时保留
+		defer context.AfterFunc(ctx, func() {
+			if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) {
+				upCancel(cause)
+			}
+		})()
+	}
+	if fallback && upErr == nil && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+		resp.Body.Close()
+		upErr = fmt.Errorf("upstream status %d", resp.StatusCode)
+		resp = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}
+	}
+	body := p.wrapBody(sess, resp.Body)
+	if fallback {
+		reopen := func(ctx context.Context) (io.ReadCloser, error) {
+			nb, err := p.openUpstream(ctx, path, r)
+			if err != nil {
+				return nil, err
+			}
+			return p.wrapBody(sess, nb), nil
+		}
+		fr := newFallbackReader(ctx, body, upErr, fb, reopen, fmt.Sprintf("user=%s path=%s", user, path), func() { p.metrics.fallbacks.Add(1) })
+		defer fr.Close()
+		body = fr
+	}
+
+	copyHeaders(w.Header(), resp.Header, cfg.ResponseHeaders.Forward)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// 错误响应只回传前 4KB，长度不再可信
+		result = "upstream_" + strconv.Itoa(resp.StatusCode)
+		w.Header().Del("Content-Length")
+		w.WriteHeader(resp.StatusCode)
+		io.CopyN(w, resp.Body, 4<<10)
+		return
+	}
+
+	// 清单（HLS 播放列表 / DASH MPD）：按 ABR 档位过滤后整体输出
+	ct := resp.Header.Get("Content-Type")
+	playlist := isPlaylist(path, ct) || isDASH(path, ct)
+	switch {
+	case isPlaylist(path, ct):
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	case playlist:
+		w.Header().Set("Content-Type", "application/dash+xml")
+	default:
+		w.Header().Set("Content-Type", "video/mp2t")
+	}
+	if playlist {
+		mb, n, err := p.filterManifest(cfg, user, target, path, ct, body)
+		if err != nil {
+			result = resultUpstreamError
+			http.Error(w, "Upstream error: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		body = mb
+		w.Header().Set("Content-Length", strconv.Itoa(n))
+	}
+	if (bp.Policy != config.BackpressureBlock || fallback) && !playlist {
+		// 跳帧/降档/备用画面会改变正文
+		w.Header().Del("Content-Length")
+	}
+	w.WriteHeader(resp.StatusCode)
+	if !playlist {
+		body = newPacedReader(ctx, body, cfg.PacingFor(ch))
+	}
+
+	fw := newFlushWriter(w, cfg.FlushFor(ch), playlist)
+	defer fw.Close()
+
+	var copyErr error
+	if bp.Policy == config.BackpressureBlock || playlist {
+		var src io.Reader = body
+		if len(prefix) > 0 {
+			// 续播：先补发暂存期间缓冲的数据（从关键帧开始）
+			src = io.MultiReader(bytes.NewReader(prefix), body)
+		}
+		buf := make([]byte, 64*1024)
+		_, copyErr = io.CopyBuffer(fw, src, buf)
+	} else {
+		var downgrade func() (io.ReadCloser, error)
+		if ch != nil && ch.DowngradePath != "" {
+			downgrade = func() (io.ReadCloser, error) {
+				nb, err := p.openUpstream(ctx, ch.DowngradePath, r)
+				if err != nil {
+					return nil, err
+				}
+				return p.wrapBody(sess, nb), nil
+			}
+		}
+		copyErr = relayWithBackpressure(ctx, fw, body, bp, downgrade)
+	}
+	if errors.Is(context.Cause(ctx), errUpstreamIdle) {
+		result = resultIdle
+		p.metrics.idleTeardowns.Add(1)
+		return
+	}
+	if r := causeResult(context.Cause(ctx)); r != "" {
+		result = r
+		return
+	}
+	if errors.Is(copyErr, errQuotaExceeded) {
+		result = resultQuotaExceeded
+		log.Printf("[StreamProxy] 流量配额用尽，断开: user=%s ip=%s path=%s", user, ip, path)
+		return
+	}
+	if errors.Is(copyErr, errClientTooSlow) {
+		result = resultTooSlow
+		log.Printf("[StreamProxy] 客户端消费过慢，断开: user=%s ip=%s path=%s", user, ip, path)
+		return
+	}
+	// 只在客户端一侧断开时暂存；上游出错时照常关闭，重连后重新回源
+	if resumeKey != "" && copyErr != nil && (fw.clientFailed() || errors.Is(context.Cause(ctx), context.Canceled)) {
+		parked = true
+		window := cfg.Resume.Window()
+		p.resume.park(resumeKey, resp, upCancel, window, cfg.Resume.BufferBytes())
+		log.Printf("[StreamProxy] 客户端断开，上游暂存 %s 等待重连: user=%s path=%s", window, user, path)
+		return
+	}
+	if copyErr != nil && !errors.Is(copyErr, context.Canceled) && !errors.Is(copyErr, net.ErrClosed) {
+		result = resultError
+		log.Printf("[StreamProxy] stream copy error: %v", copyErr)
+	}
+}
+
+// 打开额外的上游（降档、故障恢复）；非 2xx 视为失败
+func (p *Proxy) openUpstream(ctx context.Context, path string, client *http.Request) (io.ReadCloser, error) {
+	cfg := p.config(client.Context())
+	if cfg == nil {
+		return nil, errTenantRemoved
+	}
+	req, err := p.newUpstreamRequest(ctx, upstreamURL(cfg, path, client), client)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.upstreamDo(cfg, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
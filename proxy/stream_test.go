@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+func TestUpstreamURLPathQuery(t *testing.T) {
+	cfg := &config.Config{StreamHost: "http://up:8080"}
+	cfg.Normalize()
+	tests := []struct{ query, path, want string }{
+		// 旧写法：path 自带的查询串原样转发
+		{"path=" + url.QueryEscape("live/a.ts?token=abc&e=1"), "live/a.ts", "http://up:8080/live/a.ts?token=abc&e=1"},
+		{"path=live/a.ts", "live/a.ts", "http://up:8080/live/a.ts"},
+		// 文件名含 ?：%3F 属于路径，不拆分
+		{"path=" + url.QueryEscape("live/a%3Fb.ts"), "live/a%3Fb.ts", "http://up:8080/live/a%3Fb.ts"},
+		// 按频道请求时不取 path 参数
+		{"channel=news&path=" + url.QueryEscape("x?token=abc"), "live/news.ts", "http://up:8080/live/news.ts"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/stream?"+tt.query, nil)
+		if got := upstreamURL(cfg, tt.path, r); got != tt.want {
+			t.Errorf("upstreamURL(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
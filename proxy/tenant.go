@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+type tenantKey struct{}
+
+// 按 Host / URL 前缀识别租户，剥离前缀后交给内部路由
+func (p *Proxy) tenantRouter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := p.src.Get()
+		if len(cfg.Tenants) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name, prefix := cfg.MatchTenant(r.Host, r.URL.Path)
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r2 := r.WithContext(context.WithValue(r.Context(), tenantKey{}, name))
+		if prefix != "" {
+			u := *r.URL
+			u.Path = "/" + strings.TrimLeft(strings.TrimPrefix(r.URL.Path, prefix), "/")
+			// 保留编码形式（如 %2F），RawPath 与 Path 不一致时会被忽略
+			u.RawPath = "/" + strings.TrimLeft(strings.TrimPrefix(r.URL.EscapedPath(), prefix), "/")
+			r2.URL = &u
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// 当前请求生效的配置：租户请求返回租户视图，否则返回顶层配置。
+// 租户在请求过程中被移除时返回 nil
+func (p *Proxy) config(ctx context.Context) *config.Config {
+	cfg := p.src.Get()
+	if name, ok := ctx.Value(tenantKey{}).(string); ok {
+		return cfg.Tenant(name)
+	}
+	return cfg
+}
@@ -0,0 +1,418 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"math/bits"
+	"net/http"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// 内置测试源：/stream?channel=__test 输出彩条 + 时钟的 MPEG-TS，无需上游即可验证播放器与代理吞吐。
+// 视频为 H.264 Constrained Baseline：IDR 帧全部使用 I_PCM 宏块（原始像素），
+// P 帧只重编码时钟所在的宏块、其余跳过，因此不需要真正的编码器
+const (
+	testPatternChannel = "__test"
+
+	tpWidth    = 320
+	tpHeight   = 240
+	tpMBW      = tpWidth / 16
+	tpMBH      = tpHeight / 16
+	tpFPS      = 25
+	tpGOP      = 2 * tpFPS // 每 2 秒一个 IDR
+	tpPSIEvery = 5         // 每 5 帧重复一次 PAT/PMT
+
+	tpPMTPID   = 0x1000
+	tpVideoPID = 0x100
+
+	// 时钟 HH:MM:SS.FF 占一行宏块中间的 9 个
+	tpClockRow  = 13
+	tpClockCol  = 5
+	tpClockMBs  = 9
+	tpBarsUntil = 176 // 彩条占据的行数，以下为黑底
+)
+
+// serveTestPattern 加入共享的测试源（所有观众共用一个生成器）。返回会话结束原因
+func (p *Proxy) serveTestPattern(ctx context.Context, w http.ResponseWriter, cfg *config.Config, s *session) string {
+	return p.serveHub(ctx, w, cfg, nil, s, "\x00"+testPatternChannel, func(ctx context.Context, h *transcodeHub) {
+		g := newTestPattern()
+		t := time.NewTicker(time.Second / tpFPS)
+		defer t.Stop()
+		for {
+			p.transcoder.broadcast(h, g.frame(time.Now()))
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	})
+}
+
+type testPattern struct {
+	y, cb, cr []byte // 4:2:0 平面
+	n         int    // 帧序号
+	idrs      int
+	cc        map[uint16]byte // 各 PID 的 continuity_counter
+}
+
+func newTestPattern() *testPattern {
+	g := &testPattern{
+		y:  make([]byte, tpWidth*tpHeight),
+		cb: make([]byte, tpWidth*tpHeight/4),
+		cr: make([]byte, tpWidth*tpHeight/4),
+		cc: map[uint16]byte{},
+	}
+	// 75% 彩条：白、黄、青、绿、品红、红、蓝（BT.601 限幅范围）
+	bars := [][3]byte{{180, 128, 128}, {162, 44, 142}, {131, 156, 44}, {112, 72, 58}, {84, 184, 198}, {65, 100, 212}, {35, 212, 114}}
+	for y := 0; y < tpHeight; y++ {
+		for x := 0; x < tpWidth; x++ {
+			c := [3]byte{16, 128, 128}
+			if y < tpBarsUntil {
+				c = bars[x*len(bars)/tpWidth]
+			}
+			g.y[y*tpWidth+x] = c[0]
+			if x%2 == 0 && y%2 == 0 {
+				g.cb[y/2*tpWidth/2+x/2], g.cr[y/2*tpWidth/2+x/2] = c[1], c[2]
+			}
+		}
+	}
+	return g
+}
+
+// frame 生成一帧（含需要时的 PAT/PMT），返回完整的 TS 包序列
+func (g *testPattern) frame(now time.Time) []byte {
+	idr := g.n%tpGOP == 0
+	g.drawClock(now.Format("15:04:05") + "." + twoDigits(g.n%tpFPS))
+
+	es := annexB(nil, []byte{0x09, 0xf0}) // AUD
+	if idr {
+		es = annexB(es, tpSPS())
+		es = annexB(es, tpPPS())
+	}
+	es = annexB(es, g.slice(idr))
+
+	var out []byte
+	if idr || g.n%tpPSIEvery == 0 {
+		out = g.psi(out, tpPATSection(), 0)
+		out = g.psi(out, tpPMTSection(), tpPMTPID)
+	}
+	// PTS 比 PCR 提前 100ms
+	pcr := uint64(g.n) * 90000 / tpFPS
+	out = g.pes(out, es, pcr+9000, pcr, idr)
+	g.n++
+	return out
+}
+
+func twoDigits(n int) string {
+	return string([]byte{byte('0' + n/10), byte('0' + n%10)})
+}
+
+// 5x7 点阵，放大 2 倍绘制在 12x16 的格子里
+var tpFont = map[byte][7]byte{
+	'0': {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1': {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3': {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4': {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5': {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6': {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9': {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	':': {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c},
+}
+
+func (g *testPattern) drawClock(text string) {
+	x0, y0 := tpClockCol*16, tpClockRow*16
+	w := tpClockMBs * 16
+	pad := (w - len(text)*12) / 2
+	for y := 0; y < 16; y++ {
+		for x := 0; x < w; x++ {
+			v := byte(16)
+			if cx := x - pad; cx >= 0 && cx < len(text)*12 {
+				gx, gy := (cx%12-1)/2, (y-1)/2
+				if cx%12 >= 1 && gx < 5 && y >= 1 && gy < 7 && tpFont[text[cx/12]][gy]&(0x10>>gx) != 0 {
+					v = 235
+				}
+			}
+			g.y[(y0+y)*tpWidth+x0+x] = v
+		}
+	}
+}
+
+// 宏块的 I_PCM 数据：256 字节亮度 + 各 64 字节色度
+func (g *testPattern) pcm(dst []byte, mb int) []byte {
+	mx, my := mb%tpMBW*16, mb/tpMBW*16
+	for y := 0; y < 16; y++ {
+		dst = append(dst, g.y[(my+y)*tpWidth+mx:][:16]...)
+	}
+	for _, plane := range [][]byte{g.cb, g.cr} {
+		for y := 0; y < 8; y++ {
+			dst = append(dst, plane[(my/2+y)*tpWidth/2+mx/2:][:8]...)
+		}
+	}
+	return dst
+}
+
+// SPS：Constrained Baseline，level 3.0，log2_max_frame_num = 8，POC type 2，1 个参考帧
+func tpSPS() []byte {
+	w := &bitWriter{}
+	w.bits(0x67, 8)
+	w.bits(66, 8)
+	w.bits(0xc0, 8) // constraint_set0/1
+	w.bits(30, 8)
+	w.ue(0)
+	w.ue(4)
+	w.ue(2)
+	w.ue(1)
+	w.bits(0, 1)
+	w.ue(tpMBW - 1)
+	w.ue(tpMBH - 1)
+	w.bits(1, 1) // frame_mbs_only_flag
+	w.bits(1, 1) // direct_8x8_inference_flag
+	w.bits(0, 1) // frame_cropping_flag
+	w.bits(0, 1) // vui_parameters_present_flag
+	w.trailing()
+	return w.b
+}
+
+// PPS：CAVLC，开启 deblocking 控制以便在 slice 中关闭去块滤波
+func tpPPS() []byte {
+	w := &bitWriter{}
+	w.bits(0x68, 8)
+	w.ue(0)
+	w.ue(0)
+	w.bits(0, 1) // entropy_coding_mode_flag
+	w.bits(0, 1)
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	w.bits(0, 1)
+	w.bits(0, 2)
+	w.se(0)
+	w.se(0)
+	w.se(0)
+	w.bits(1, 1) // deblocking_filter_control_present_flag
+	w.bits(0, 1)
+	w.bits(0, 1)
+	w.trailing()
+	return w.b
+}
+
+func (g *testPattern) slice(idr bool) []byte {
+	w := &bitWriter{}
+	if idr {
+		w.bits(0x65, 8)
+	} else {
+		w.bits(0x41, 8)
+	}
+	w.ue(0) // first_mb_in_slice
+	if idr {
+		w.ue(7) // I
+	} else {
+		w.ue(5) // P
+	}
+	w.ue(0)
+	w.bits(uint32(g.n%tpGOP), 8) // frame_num
+	if idr {
+		w.ue(uint32(g.idrs % 2)) // 相邻 IDR 的 idr_pic_id 须不同
+		g.idrs++
+	} else {
+		w.bits(0, 1) // num_ref_idx_active_override_flag
+		w.bits(0, 1) // ref_pic_list_modification_flag_l0
+	}
+	if idr {
+		w.bits(0, 2) // no_output_of_prior_pics_flag, long_term_reference_flag
+	} else {
+		w.bits(0, 1) // adaptive_ref_pic_marking_mode_flag
+	}
+	w.se(0) // slice_qp_delta
+	w.ue(1) // disable_deblocking_filter_idc
+
+	const total = tpMBW * tpMBH
+	var pcm []byte
+	if idr {
+		for mb := 0; mb < total; mb++ {
+			w.ue(25) // I_PCM
+			w.align()
+			pcm = g.pcm(pcm[:0], mb)
+			w.b = append(w.b, pcm...)
+		}
+	} else {
+		first := tpClockRow*tpMBW + tpClockCol
+		w.ue(uint32(first)) // mb_skip_run
+		for i := range tpClockMBs {
+			if i > 0 {
+				w.ue(0)
+			}
+			w.ue(5 + 25) // P 片中的 I_PCM
+			w.align()
+			pcm = g.pcm(pcm[:0], first+i)
+			w.b = append(w.b, pcm...)
+		}
+		if rest := total - first - tpClockMBs; rest > 0 {
+			w.ue(uint32(rest))
+		}
+	}
+	w.trailing()
+	return w.b
+}
+
+// 追加起始码与 NAL（含防竞争字节）
+func annexB(dst, nal []byte) []byte {
+	dst = append(dst, 0, 0, 0, 1, nal[0])
+	zeros := 0
+	for _, b := range nal[1:] {
+		if zeros >= 2 && b <= 3 {
+			dst = append(dst, 3)
+			zeros = 0
+		}
+		dst = append(dst, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return dst
+}
+
+type bitWriter struct {
+	b   []byte
+	cur byte
+	n   uint8
+}
+
+func (w *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.cur = w.cur<<1 | byte(v>>i&1)
+		if w.n++; w.n == 8 {
+			w.b = append(w.b, w.cur)
+			w.cur, w.n = 0, 0
+		}
+	}
+}
+
+// Exp-Golomb
+func (w *bitWriter) ue(v uint32) {
+	n := bits.Len32(v + 1)
+	w.bits(0, n-1)
+	w.bits(v+1, n)
+}
+
+func (w *bitWriter) se(v int32) {
+	if v > 0 {
+		w.ue(uint32(2*v - 1))
+	} else {
+		w.ue(uint32(-2 * v))
+	}
+}
+
+func (w *bitWriter) align() {
+	for w.n != 0 {
+		w.bits(0, 1)
+	}
+}
+
+func (w *bitWriter) trailing() {
+	w.bits(1, 1)
+	w.align()
+}
+
+func tpPATSection() []byte {
+	return []byte{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xe0 | tpPMTPID>>8, tpPMTPID & 0xff}
+}
+
+func tpPMTSection() []byte {
+	return []byte{0x02, 0xb0, 0x12, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe0 | tpVideoPID>>8, tpVideoPID & 0xff, 0xf0, 0x00,
+		0x1b, 0xe0 | tpVideoPID>>8, tpVideoPID & 0xff, 0xf0, 0x00}
+}
+
+func (g *testPattern) nextCC(pid uint16) byte {
+	c := g.cc[pid]
+	g.cc[pid] = (c + 1) & 0x0f
+	return c
+}
+
+// 单包 PSI 段，附 CRC32
+func (g *testPattern) psi(dst, section []byte, pid uint16) []byte {
+	pkt := make([]byte, tsPacketSize)
+	pkt[0], pkt[1], pkt[2], pkt[3] = 0x47, 0x40|byte(pid>>8), byte(pid), 0x10|g.nextCC(pid)
+	n := 5 + copy(pkt[5:], section) // pkt[4]: pointer_field
+	crc := crc32MPEG(section)
+	pkt[n], pkt[n+1], pkt[n+2], pkt[n+3] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+	for i := n + 4; i < len(pkt); i++ {
+		pkt[i] = 0xff
+	}
+	return append(dst, pkt...)
+}
+
+// 把一帧封装为 PES 并切成 TS 包；首包携带 PCR，IDR 帧置 random_access_indicator
+func (g *testPattern) pes(dst, es []byte, pts, pcr uint64, idr bool) []byte {
+	data := append([]byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5,
+		0x21 | byte(pts>>29)&0x0e, byte(pts >> 22), byte(pts>>14) | 1, byte(pts >> 7), byte(pts<<1) | 1}, es...)
+	for first := true; len(data) > 0; first = false {
+		var af []byte // adaptation field（不含长度字节）
+		if first {
+			flags := byte(0x10) // PCR_flag
+			if idr {
+				flags |= 0x40
+			}
+			af = []byte{flags, byte(pcr >> 25), byte(pcr >> 17), byte(pcr >> 9), byte(pcr >> 1), byte(pcr&1)<<7 | 0x7e, 0}
+		}
+		afLen := 0
+		if af != nil {
+			afLen = 1 + len(af)
+		}
+		// 最后一个包不足 184 字节时用 adaptation field 填充
+		if stuff := 184 - afLen - len(data); stuff > 0 {
+			switch {
+			case af != nil:
+				af = append(af, bytes.Repeat([]byte{0xff}, stuff)...)
+			case stuff == 1:
+				af = []byte{}
+			default:
+				af = append([]byte{0}, bytes.Repeat([]byte{0xff}, stuff-2)...)
+			}
+		}
+		space := 184
+		if af != nil {
+			space -= 1 + len(af)
+		}
+		pkt := make([]byte, 4, tsPacketSize)
+		pkt[0], pkt[1], pkt[2] = 0x47, byte(tpVideoPID>>8), byte(tpVideoPID&0xff)
+		if first {
+			pkt[1] |= 0x40
+		}
+		pkt[3] = 0x10 | g.nextCC(tpVideoPID)
+		if af != nil {
+			pkt[3] |= 0x20
+			pkt = append(pkt, byte(len(af)))
+			pkt = append(pkt, af...)
+		}
+		pkt = append(pkt, data[:space]...)
+		data = data[space:]
+		dst = append(dst, pkt...)
+	}
+	return dst
+}
+
+// MPEG-2 CRC32（多项式 0x04C11DB7，不反射）
+func crc32MPEG(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, x := range b {
+		crc ^= uint32(x) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
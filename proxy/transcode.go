@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+const (
+	// 最后一个观众离开后 ffmpeg 保留的时间，便于切台回来或短暂断线
+	transcodeLinger = 5 * time.Second
+	// 每个观众的待发送队列（块数），写满视为客户端过慢
+	transcodeSubQueue = 64
+	// 重启退避上限；稳定运行超过 transcodeStableAfter 后退避归零
+	transcodeMaxBackoff  = 10 * time.Second
+	transcodeStableAfter = 30 * time.Second
+)
+
+var errTranscodeStopped = errors.New("transcoder stopped")
+
+// 转码中心：同一频道 + 档位共用一个 ffmpeg 进程，输出分发给所有观众
+type transcoder struct {
+	mu     sync.Mutex
+	hubs   map[string]*transcodeHub
+	closed bool
+}
+
+type transcodeHub struct {
+	key    string
+	cancel context.CancelFunc
+	linger *time.Timer
+	subs   map[*hubSub]struct{} // 由 transcoder.mu 保护
+}
+
+type hubSub struct {
+	hub    *transcodeHub
+	ch     chan []byte
+	synced bool // 已从关键帧开始输出
+	err    error
+}
+
+func newTranscoder() *transcoder {
+	return &transcoder{hubs: map[string]*transcodeHub{}}
+}
+
+// subscribe 加入 key 对应的转码；不存在时用 run 启动
+func (t *transcoder) subscribe(key string, run func(ctx context.Context, h *transcodeHub)) (*hubSub, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, errShutdown
+	}
+	h := t.hubs[key]
+	if h == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		h = &transcodeHub{key: key, cancel: cancel, subs: map[*hubSub]struct{}{}}
+		t.hubs[key] = h
+		go func() {
+			run(ctx, h)
+			t.stop(h, errTranscodeStopped)
+		}()
+	}
+	if h.linger != nil {
+		h.linger.Stop()
+		h.linger = nil
+	}
+	s := &hubSub{hub: h, ch: make(chan []byte, transcodeSubQueue)}
+	h.subs[s] = struct{}{}
+	return s, nil
+}
+
+func (t *transcoder) unsubscribe(s *hubSub) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := s.hub
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	if len(h.subs) == 0 && t.hubs[h.key] == h {
+		var tm *time.Timer
+		tm = time.AfterFunc(transcodeLinger, func() {
+			// 判断空闲与停止在同一次加锁内完成；期间有人加入时 subscribe 已清除 linger
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if h.linger == tm && len(h.subs) == 0 {
+				t.stopLocked(h, errTranscodeStopped)
+			}
+		})
+		h.linger = tm
+	}
+}
+
+// 停止转码并关闭全部观众
+func (t *transcoder) stop(h *transcodeHub, cause error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopLocked(h, cause)
+}
+
+func (t *transcoder) stopLocked(h *transcodeHub, cause error) {
+	if h.linger != nil {
+		h.linger.Stop()
+		h.linger = nil
+	}
+	if t.hubs[h.key] == h {
+		delete(t.hubs, h.key)
+	}
+	h.cancel()
+	for s := range h.subs {
+		s.err = cause
+		close(s.ch)
+		delete(h.subs, s)
+	}
+}
+
+func (t *transcoder) closeAll() {
+	t.mu.Lock()
+	t.closed = true
+	hubs := make([]*transcodeHub, 0, len(t.hubs))
+	for _, h := range t.hubs {
+		hubs = append(hubs, h)
+	}
+	t.mu.Unlock()
+	for _, h := range hubs {
+		t.stop(h, errShutdown)
+	}
+}
+
+func (t *transcoder) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.hubs)
+}
+
+// 分发一块输出；新观众从关键帧开始，队列写满的观众断开
+func (t *transcoder) broadcast(h *transcodeHub, b []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for s := range h.subs {
+		chunk := b
+		if !s.synced {
+			off := tsKeyframeOffset(chunk)
+			if off < 0 {
+				continue
+			}
+			chunk, s.synced = chunk[off:], true
+		}
+		select {
+		case s.ch <- chunk:
+		default:
+			s.err = errClientTooSlow
+			close(s.ch)
+			delete(h.subs, s)
+		}
+	}
+}
+
+// 上游地址（不含客户端参数），用于多个观众共享的拉流
+func baseUpstreamURL(cfg *config.Config, path string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimRight(cfg.StreamHost, "/"), strings.TrimLeft(path, "/"))
+}
+
+// 转码频道：加入共享的 ffmpeg 输出。返回会话结束原因
+func (p *Proxy) serveTranscode(ctx context.Context, w http.ResponseWriter, cfg *config.Config, ch *config.ChannelCfg, s *session) string {
+	tc, ok := cfg.TranscodeProfiles[ch.Transcode]
+	if !ok {
+		log.Printf("[StreamProxy] 频道 %s 引用了未定义的转码档位 %q", s.channel, ch.Transcode)
+		http.Error(w, "Unknown transcode profile", http.StatusInternalServerError)
+		return resultError
+	}
+	src := baseUpstreamURL(cfg, ch.Path)
+	key := s.tenant + "\x00" + s.channel + "\x00" + ch.Transcode + "\x00" + src
+	return p.serveHub(ctx, w, cfg, ch, s, key, func(ctx context.Context, h *transcodeHub) {
+		p.superviseFFmpeg(ctx, h, cfg, tc, src)
+	})
+}
+
+// 加入 key 对应的共享输出（不存在时用 run 启动）并转发给客户端。返回会话结束原因
+func (p *Proxy) serveHub(ctx context.Context, w http.ResponseWriter, cfg *config.Config, ch *config.ChannelCfg, s *session, key string, run func(ctx context.Context, h *transcodeHub)) string {
+	sub, err := p.transcoder.subscribe(key, run)
+	if err != nil {
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return resultShutdown
+	}
+	defer p.transcoder.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.WriteHeader(http.StatusOK)
+	fw := newFlushWriter(w, cfg.FlushFor(ch), false)
+	defer fw.Close()
+	for {
+		select {
+		case b, ok := <-sub.ch:
+			if !ok {
+				if errors.Is(sub.err, errClientTooSlow) {
+					return resultTooSlow
+				}
+				return resultUpstreamError
+			}
+			s.upBytes.Add(int64(len(b)))
+			if _, err := fw.Write(b); err != nil {
+				return resultOK
+			}
+		case <-ctx.Done():
+			if r := causeResult(context.Cause(ctx)); r != "" {
+				return r
+			}
+			return resultOK
+		}
+	}
+}
+
+// 运行 ffmpeg，退出后按指数退避重启，直到 ctx 结束（最后一个观众离开或关闭）
+func (p *Proxy) superviseFFmpeg(ctx context.Context, h *transcodeHub, cfg *config.Config, tc config.TranscodeCfg, src string) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := p.runFFmpeg(ctx, h, cfg, tc, src)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > transcodeStableAfter {
+			backoff = time.Second
+		}
+		p.metrics.transcodeRestarts.Add(1)
+		log.Printf("[StreamProxy] ffmpeg 退出，%s 后重启: src=%s err=%v", backoff, src, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, transcodeMaxBackoff)
+	}
+}
+
+func (p *Proxy) runFFmpeg(ctx context.Context, h *transcodeHub, cfg *config.Config, tc config.TranscodeCfg, src string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "*/*")
+	resp, err := p.upstreamDo(cfg, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("upstream status %d", resp.StatusCode)
+	}
+
+	args := append([]string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0"}, tc.Args...)
+	args = append(args, "-f", "mpegts", "pipe:1")
+	cmd := exec.CommandContext(ctx, cfg.FFmpegPath(), args...)
+	cmd.Stdin = resp.Body
+	var stderr tailBuffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("[StreamProxy] ffmpeg 已启动: pid=%d src=%s", cmd.Process.Pid, src)
+	for {
+		buf := make([]byte, relayChunk)
+		n, rerr := out.Read(buf)
+		if n > 0 {
+			p.transcoder.broadcast(h, buf[:n])
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	err = cmd.Wait()
+	if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+		return fmt.Errorf("%v: %s", err, msg)
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+// 只保留最后 4KB 的 stderr，供退出时记录
+type tailBuffer struct {
+	b []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.b = append(t.b, p...)
+	if over := len(t.b) - 4096; over > 0 {
+		t.b = t.b[over:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) Bytes() []byte { return t.b }
@@ -0,0 +1,31 @@
+package proxy
+
+// MPEG-TS 基础解析
+const tsPacketSize = 188
+
+// 下一个 TS 包起始位置（0x47 且后一个包位置也是 0x47）；未找到返回 -1
+func tsSyncOffset(b []byte) int {
+	for i := 0; i < len(b); i++ {
+		if b[i] == 0x47 && (i+tsPacketSize >= len(b) || b[i+tsPacketSize] == 0x47) {
+			return i
+		}
+	}
+	return -1
+}
+
+// 下一个带 random_access_indicator 的 TS 包（关键帧起点）；未找到返回 -1
+func tsKeyframeOffset(b []byte) int {
+	for i := 0; i+6 <= len(b); i++ {
+		if b[i] != 0x47 || (i+tsPacketSize < len(b) && b[i+tsPacketSize] != 0x47) {
+			continue
+		}
+		// adaptation_field_control 含 adaptation field，且长度 > 0
+		if b[i+3]&0x20 == 0 || b[i+4] == 0 {
+			continue
+		}
+		if b[i+5]&0x40 != 0 {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// 按 SNI 区分的上游客户端：连接池按地址复用，不同 SNI 不能共用同一个池
+type sniClients struct {
+	mu sync.Mutex
+	m  map[string]*http.Client
+}
+
+func (p *Proxy) clientForSNI(sni string) *http.Client {
+	if sni == "" {
+		return p.client
+	}
+	p.sni.mu.Lock()
+	defer p.sni.mu.Unlock()
+	if c, ok := p.sni.m[sni]; ok {
+		return c
+	}
+	c := newHTTPClient(p.dialUpstream)
+	c.Transport.(*http.Transport).TLSClientConfig = &tls.Config{ServerName: sni}
+	if p.sni.m == nil {
+		p.sni.m = map[string]*http.Client{}
+	}
+	p.sni.m[sni] = c
+	return c
+}
+
+func (p *Proxy) closeIdleUpstreams() {
+	p.client.CloseIdleConnections()
+	p.sni.mu.Lock()
+	defer p.sni.mu.Unlock()
+	for _, c := range p.sni.m {
+		c.CloseIdleConnections()
+	}
+}
+
+// upstreamDo 发起上游请求；目标为 stream_host 时应用 stream_host_header 与 stream_sni
+// （经 rewrite_url 改写到其它主机的请求不受影响）
+func (p *Proxy) upstreamDo(cfg *config.Config, req *http.Request) (*http.Response, error) {
+	if !sameOrigin(req.URL, cfg.StreamHost) {
+		return p.client.Do(req)
+	}
+	if cfg.StreamHostHeader != "" {
+		req.Host = cfg.StreamHostHeader
+	}
+	return p.clientForSNI(cfg.StreamSNI).Do(req)
+}
+
+func sameOrigin(u *url.URL, base string) bool {
+	b, err := url.Parse(base)
+	return err == nil && b.Scheme == u.Scheme && b.Host == u.Host
+}
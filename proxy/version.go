@@ -0,0 +1,32 @@
+package proxy
+
+import "fmt"
+
+// BuildInfo 版本与构建信息
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func (b BuildInfo) String() string {
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", b.Version, shortCommit(b.Commit), b.Date, b.GoVersion)
+}
+
+func shortCommit(c string) string {
+	if len(c) > 12 {
+		return c[:12]
+	}
+	return c
+}
+
+// SetBuildInfo 设置版本信息，用于 build_info 指标与管理接口
+func (p *Proxy) SetBuildInfo(b BuildInfo) {
+	p.build = b
+}
+
+// BuildInfo 返回版本信息
+func (p *Proxy) BuildInfo() BuildInfo {
+	return p.build
+}
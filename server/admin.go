@@ -0,0 +1,198 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"r9mc.com/stream-proxy/auth"
+	"r9mc.com/stream-proxy/history"
+	"r9mc.com/stream-proxy/proxy"
+)
+
+// 管理接口统一鉴权；未配置 admin.token 时一律 404，避免暴露接口存在
+func (s *Server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.Store.Get()
+		if cfg.Admin.Token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !auth.Admin(cfg, r) {
+			http.Error(w, "Invalid admin credentials", http.StatusForbidden)
+			return
+		}
+		s.Proxy.Compress(h).ServeHTTP(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// GET /admin/sessions
+func (s *Server) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.Proxy.Sessions())
+}
+
+// POST /admin/kick?id=<会话ID> 或 ?user=<用户名>（租户用户为 租户/用户名）
+func (s *Server) kickHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, _ := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	user := r.URL.Query().Get("user")
+	if id == 0 && user == "" {
+		http.Error(w, "Missing parameters", http.StatusBadRequest)
+		return
+	}
+	if id != 0 {
+		writeJSON(w, map[string]int{"kicked": s.Proxy.Kick(id, "")})
+		return
+	}
+	// 按用户踢出时同时转发给集群中的其它节点
+	writeJSON(w, map[string]int{"kicked": s.Proxy.KickUser(r.Context(), user)})
+}
+
+// GET /admin/maintenance 查看状态；POST /admin/maintenance?enabled=true|false&message=
+func (s *Server) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.Proxy.Maintenance())
+	case http.MethodPost:
+		on, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "Invalid enabled", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, s.Proxy.SetMaintenance(on, r.URL.Query().Get("message")))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GET /admin/probe?channel=<频道>&tenant=<租户> 立即探测单个频道；
+// 不带 channel 时返回所有频道（启用后台探测时为最近一轮结果）
+func (s *Server) probeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("channel") == "" {
+		writeJSON(w, s.Proxy.ProbeAll(r.Context()))
+		return
+	}
+	res, ok := s.Proxy.ProbeChannel(r.Context(), q.Get("tenant"), q.Get("channel"))
+	if !ok {
+		http.Error(w, "Unknown channel", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, res)
+}
+
+// GET /admin/quota?user= 查看当前计费周期的流量；POST /admin/quota?user= 清零该用户用量
+// 租户用户写作 租户/用户名
+func (s *Server) quotaHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.Proxy.QuotaUsages(user))
+	case http.MethodPost:
+		if user == "" {
+			http.Error(w, "Missing parameters", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]bool{"reset": s.Proxy.ResetQuota(r.Context(), user)})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GET /admin/cluster
+func (s *Server) clusterInfoHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.Proxy.ClusterInfo())
+}
+
+// GET /admin/stats/channels?top=10&by=peak|viewers|sessions|watch
+// current 为当前有人观看的频道，top 为按 by 排序的前 N 个
+func (s *Server) channelStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := s.Proxy.ChannelStats()
+	current := slices.DeleteFunc(slices.Clone(stats), func(st proxy.ChannelStat) bool { return st.Viewers == 0 })
+
+	n := 10
+	if v, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && v > 0 {
+		n = v
+	}
+	var key func(proxy.ChannelStat) int64
+	switch r.URL.Query().Get("by") {
+	case "", "peak":
+		key = func(st proxy.ChannelStat) int64 { return int64(st.Peak) }
+	case "viewers":
+		key = func(st proxy.ChannelStat) int64 { return int64(st.Viewers) }
+	case "sessions":
+		key = func(st proxy.ChannelStat) int64 { return st.Sessions }
+	case "watch":
+		key = func(st proxy.ChannelStat) int64 { return st.WatchSeconds }
+	default:
+		http.Error(w, "Invalid by", http.StatusBadRequest)
+		return
+	}
+	slices.SortStableFunc(stats, func(a, b proxy.ChannelStat) int { return cmp.Compare(key(b), key(a)) })
+	writeJSON(w, map[string]any{"current": current, "top": stats[:min(n, len(stats))]})
+}
+
+// GET /admin/version
+func (s *Server) versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.Proxy.BuildInfo())
+}
+
+// GET /admin/sessions/history?user=&tenant=&channel=&ip=&result=&since=&until=&limit=
+// since/until 接受 RFC3339 或 Unix 秒
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	h := s.Proxy.History()
+	if h == nil {
+		http.Error(w, "History not enabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	f := history.Filter{
+		Tenant: q.Get("tenant"), User: q.Get("user"), Channel: q.Get("channel"),
+		IP: q.Get("ip"), Result: q.Get("result"),
+	}
+	var err error
+	if f.Since, err = parseTime(q.Get("since")); err != nil {
+		http.Error(w, "Invalid since", http.StatusBadRequest)
+		return
+	}
+	if f.Until, err = parseTime(q.Get("until")); err != nil {
+		http.Error(w, "Invalid until", http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	recs, err := h.Query(f)
+	if err != nil {
+		http.Error(w, "History query failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, recs)
+}
+
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// 集群节点间接口：按 cluster.secret 鉴权；未配置 secret 时一律 404
+func (s *Server) clusterPeer(h func(*http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cc := s.Store.Get().Cluster
+		if cc.Secret == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Cluster-Secret")), []byte(cc.Secret)) != 1 {
+			http.Error(w, "Invalid cluster secret", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 8<<20)
+		out, err := h(r)
+		if err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, out)
+	}
+}
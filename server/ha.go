@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+	"r9mc.com/stream-proxy/proxy"
+)
+
+// primary 提供给 standby 的同步数据
+type haState struct {
+	Config      []byte                `json:"config"` // 配置文件原文
+	Sessions    []proxy.SessionInfo   `json:"sessions"`
+	Maintenance proxy.MaintenanceInfo `json:"maintenance"`
+	Period      time.Time             `json:"period"`
+	Usage       map[string]int64      `json:"usage,omitempty"`
+}
+
+// HAStatus 主备状态，供 /admin/ha 查看
+type HAStatus struct {
+	Role     string    `json:"role"`
+	Active   bool      `json:"active"`
+	Peer     string    `json:"peer,omitempty"`
+	LastSync time.Time `json:"last_sync"`
+	Failures int       `json:"failures"`
+	// standby：最近一次同步到的 primary 会话
+	PeerSessions []proxy.SessionInfo `json:"peer_sessions,omitempty"`
+}
+
+type haMonitor struct {
+	mu     sync.Mutex
+	status HAStatus
+}
+
+// GET /ha/state：按 ha.secret 鉴权，仅 primary 提供
+func (s *Server) haStateHandler(w http.ResponseWriter, r *http.Request) {
+	hc := s.Store.Get().HA
+	if hc.Role != config.HAPrimary || hc.Secret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-HA-Secret")), []byte(hc.Secret)) != 1 {
+		http.Error(w, "Invalid HA secret", http.StatusForbidden)
+		return
+	}
+	raw, err := os.ReadFile(s.Store.Path())
+	if err != nil {
+		http.Error(w, "Config unavailable", http.StatusInternalServerError)
+		return
+	}
+	st := haState{Config: raw, Sessions: s.Proxy.Sessions(), Maintenance: s.Proxy.Maintenance()}
+	st.Period, st.Usage = s.Proxy.QuotaState()
+	writeJSON(w, st)
+}
+
+// GET /admin/ha
+func (s *Server) haStatusHandler(w http.ResponseWriter, r *http.Request) {
+	s.ha.mu.Lock()
+	defer s.ha.mu.Unlock()
+	st := s.ha.status
+	st.Role = s.Store.Get().HA.Role
+	st.Active = !s.Proxy.Standby()
+	writeJSON(w, st)
+}
+
+// 确定初始主备状态；须在监听开始前调用，返回 true 时需运行 haLoop
+func (s *Server) haStart() bool {
+	hc := s.Store.Get().HA
+	if hc.Role != config.HAStandby {
+		return false
+	}
+	if hc.Peer == "" {
+		log.Printf("[StreamProxy] ha.role 为 standby 但未配置 ha.peer，按活动节点运行")
+		return false
+	}
+	s.Proxy.SetStandby(true)
+	log.Printf("[StreamProxy] 以待机节点启动，primary=%s", hc.Peer)
+	return true
+}
+
+// standby 主循环：同步 primary 的状态，连续失败达到阈值后接管，primary 恢复同样次数后交还
+func (s *Server) haLoop(ctx context.Context) {
+	hc := s.Store.Get().HA
+	client := &http.Client{Timeout: 2 * time.Second}
+	var fails, oks int
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(hc.Interval()):
+		}
+		hc = s.Store.Get().HA
+		st, err := s.fetchHAState(ctx, client, hc)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fails, oks = fails+1, 0
+			if s.Proxy.Standby() && fails >= hc.Failures() {
+				log.Printf("[StreamProxy] primary 连续 %d 次不可达，接管服务: %v", fails, err)
+				s.Proxy.SetStandby(false)
+				runHAHook(hc.OnActive)
+			}
+		} else {
+			fails, oks = 0, oks+1
+			s.applyHAState(st)
+			if !s.Proxy.Standby() && oks >= hc.Failures() {
+				log.Printf("[StreamProxy] primary 已恢复，转为待机")
+				s.Proxy.SetStandby(true)
+				runHAHook(hc.OnStandby)
+			}
+		}
+		s.ha.mu.Lock()
+		s.ha.status.Peer, s.ha.status.Failures = hc.Peer, fails
+		if err == nil {
+			s.ha.status.LastSync, s.ha.status.PeerSessions = time.Now(), st.Sessions
+		}
+		s.ha.mu.Unlock()
+	}
+}
+
+func (s *Server) fetchHAState(ctx context.Context, client *http.Client, hc config.HACfg) (haState, error) {
+	var st haState
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(hc.Peer, "/")+"/ha/state", nil)
+	if err != nil {
+		return st, err
+	}
+	req.Header.Set("X-HA-Secret", hc.Secret)
+	resp, err := client.Do(req)
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return st, json.NewDecoder(resp.Body).Decode(&st)
+}
+
+func (s *Server) applyHAState(st haState) {
+	if err := s.mirrorConfig(st.Config); err != nil {
+		log.Printf("[StreamProxy] 同步 primary 配置失败: %v", err)
+	}
+	if cur := s.Proxy.Maintenance(); cur.Enabled != st.Maintenance.Enabled || cur.Message != st.Maintenance.Message {
+		s.Proxy.SetMaintenance(st.Maintenance.Enabled, st.Maintenance.Message)
+	}
+	s.Proxy.MergeQuota(st.Period, st.Usage)
+}
+
+// 用 primary 的配置覆盖本地配置文件，保留本地的 ha 与 listen；内容未变化时不写入
+func (s *Server) mirrorConfig(remote []byte) error {
+	path := s.Store.Path()
+	local, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var lm, rm map[string]json.RawMessage
+	if err := json.Unmarshal(local, &lm); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(remote, &rm); err != nil {
+		return err
+	}
+	for _, k := range []string{"ha", "listen"} {
+		if v, ok := lm[k]; ok {
+			rm[k] = v
+		} else {
+			delete(rm, k)
+		}
+	}
+	if haEqual(lm, rm) {
+		return nil
+	}
+	out, err := json.MarshalIndent(rm, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(out, '\n'), 0o644); err != nil {
+		return err
+	}
+	log.Printf("[StreamProxy] 已同步 primary 配置")
+	return os.Rename(tmp, path)
+}
+
+// 逐项比较（忽略格式差异）
+func haEqual(a, b map[string]json.RawMessage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		w, ok := b[k]
+		if !ok {
+			return false
+		}
+		var cv, cw bytes.Buffer
+		if json.Compact(&cv, v) != nil || json.Compact(&cw, w) != nil || !bytes.Equal(cv.Bytes(), cw.Bytes()) {
+			return false
+		}
+	}
+	return true
+}
+
+func runHAHook(argv []string) {
+	if len(argv) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).CombinedOutput()
+	if err != nil {
+		log.Printf("[StreamProxy] 主备切换命令执行失败: %v: %s", err, bytes.TrimSpace(out))
+	}
+}
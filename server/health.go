@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"r9mc.com/stream-proxy/auth"
+	"r9mc.com/stream-proxy/config"
+)
+
+// minimal：仅 ok；basic：附加活跃会话数；full：附加用户名、配置文件、监听与上游信息
+var healthLevels = []string{config.HealthMinimal, config.HealthBasic, config.HealthFull}
+
+// 公开访问返回 health.public_detail 级别；携带管理凭据时可用 ?detail= 提升到任意级别（默认 full）
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := s.Store.Get()
+	level := cfg.Health.PublicDetail
+	if auth.Admin(cfg, r) {
+		level = config.HealthFull
+		if d := r.URL.Query().Get("detail"); slices.Contains(healthLevels, d) {
+			level = d
+		}
+	}
+
+	// 待机节点对负载均衡器报告不健康，流量只进入活动节点
+	if s.Proxy.Standby() {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]any{"ok": false, "standby": true})
+		return
+	}
+
+	type basic struct {
+		OK       bool `json:"ok"`
+		Sessions int  `json:"sessions"`
+	}
+	switch level {
+	case config.HealthFull:
+		out := struct {
+			basic
+			Users       []string         `json:"users"`
+			Tenants     []string         `json:"tenants,omitempty"`
+			ConfigFile  string           `json:"config_file"`
+			Listen      config.ListenCfg `json:"listen"`
+			StreamHost  string           `json:"stream_host"`
+			Version     string           `json:"version"`
+			Maintenance bool             `json:"maintenance,omitempty"`
+		}{
+			basic:       basic{OK: true, Sessions: len(s.Proxy.Sessions())},
+			Users:       make([]string, 0, len(cfg.Users)),
+			ConfigFile:  abs(s.Store.Path()),
+			Listen:      cfg.Listen,
+			StreamHost:  cfg.StreamHost,
+			Version:     s.Proxy.BuildInfo().Version,
+			Maintenance: s.Proxy.Maintenance().Enabled,
+		}
+		for k := range cfg.Users {
+			out.Users = append(out.Users, k)
+		}
+		slices.Sort(out.Users)
+		for k := range cfg.Tenants {
+			out.Tenants = append(out.Tenants, k)
+		}
+		slices.Sort(out.Tenants)
+		writeJSON(w, out)
+	case config.HealthBasic:
+		writeJSON(w, basic{OK: true, Sessions: len(s.Proxy.Sessions())})
+	default:
+		writeJSON(w, struct {
+			OK bool `json:"ok"`
+		}{true})
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// Listen 按 TCPCfg 创建监听；长连接高码率场景下系统默认值往往不合适
+func Listen(addr string, tc config.TCPCfg) (net.Listener, error) {
+	lc := net.ListenConfig{
+		KeepAliveConfig: net.KeepAliveConfig{
+			Enable:   tc.KeepAliveIdleSec >= 0,
+			Idle:     time.Duration(tc.KeepAliveIdleSec) * time.Second,
+			Interval: time.Duration(tc.KeepAliveIntervalSec) * time.Second,
+			Count:    tc.KeepAliveCount,
+		},
+	}
+	// 未配置的字段保持 0，由 Go 取默认值（idle/interval 15s，count 9）
+	if tc.KeepAliveIdleSec < 0 {
+		lc.KeepAlive = -1
+	}
+	if tc.ReusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) { serr = setReusePort(fd) }); err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	ln, err := lc.Listen(context.Background(), listenNetwork(addr), addr)
+	if err != nil {
+		return nil, err
+	}
+	if tc.NoDelay == nil && tc.SendBuffer == 0 && tc.RecvBuffer == 0 {
+		return ln, nil
+	}
+	return &tunedListener{Listener: ln, cfg: tc}, nil
+}
+
+// IP 字面量按地址族监听：IPv6 通配地址只收 IPv6（IPV6_V6ONLY），可与 0.0.0.0 同端口并存；
+// 其余（空 host、主机名）沿用 "tcp"，在 Linux 上空 host 即为双栈
+func listenNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() {
+			return "tcp4"
+		}
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// 对每个 accept 的连接应用 socket 选项
+type tunedListener struct {
+	net.Listener
+	cfg config.TCPCfg
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		if l.cfg.NoDelay != nil {
+			_ = tc.SetNoDelay(*l.cfg.NoDelay)
+		}
+		if l.cfg.SendBuffer > 0 {
+			_ = tc.SetWriteBuffer(l.cfg.SendBuffer)
+		}
+		if l.cfg.RecvBuffer > 0 {
+			_ = tc.SetReadBuffer(l.cfg.RecvBuffer)
+		}
+	}
+	return c, nil
+}
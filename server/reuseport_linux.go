@@ -0,0 +1,12 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x)
+
+package server
+
+import "syscall"
+
+// syscall 包在 linux 下未导出 SO_REUSEPORT；以上架构均为 15（mips 等见 reuseport_mipsx.go）
+const soReusePort = 0xf
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
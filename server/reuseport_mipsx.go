@@ -0,0 +1,12 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package server
+
+import "syscall"
+
+// mips 沿用 IRIX 的 socket 选项编号，SO_REUSEPORT 为 0x200
+const soReusePort = 0x200
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
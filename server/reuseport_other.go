@@ -0,0 +1,9 @@
+//go:build !(darwin || freebsd || netbsd || openbsd || dragonfly) && !(linux && (386 || amd64 || arm || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x || mips || mipsle || mips64 || mips64le))
+
+package server
+
+import "errors"
+
+func setReusePort(fd uintptr) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
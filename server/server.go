@@ -0,0 +1,132 @@
+// Package server 组装 HTTP 服务：监听调优、路由与健康检查。
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+	"r9mc.com/stream-proxy/proxy"
+)
+
+// 关闭时等待连接退出的上限，超时后强制关闭
+const shutdownTimeout = 10 * time.Second
+
+type Server struct {
+	Store *config.Store
+	Proxy *proxy.Proxy
+
+	ha haMonitor
+}
+
+// Handler 返回完整路由：代理路由 + /health + /admin/*
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", s.Proxy.Handler())
+	mux.HandleFunc("/health", s.healthHandler)
+	mux.HandleFunc("/admin/sessions", s.admin(s.sessionsHandler))
+	mux.HandleFunc("/admin/sessions/history", s.admin(s.historyHandler))
+	mux.HandleFunc("/admin/kick", s.admin(s.kickHandler))
+	mux.HandleFunc("/admin/maintenance", s.admin(s.maintenanceHandler))
+	mux.HandleFunc("/admin/probe", s.admin(s.probeHandler))
+	mux.HandleFunc("/admin/quota", s.admin(s.quotaHandler))
+	mux.HandleFunc("/admin/cluster", s.admin(s.clusterInfoHandler))
+	mux.HandleFunc("/admin/ha", s.admin(s.haStatusHandler))
+	mux.HandleFunc("/admin/version", s.admin(s.versionHandler))
+	mux.HandleFunc("/admin/stats/channels", s.admin(s.channelStatsHandler))
+	mux.HandleFunc("/ha/state", s.haStateHandler)
+	mux.HandleFunc("/cluster/gossip", s.clusterPeer(s.Proxy.ClusterGossip))
+	mux.HandleFunc("/cluster/command", s.clusterPeer(s.Proxy.ClusterCommand))
+	return mux
+}
+
+// ListenAndServe 按配置中的 listen 启动服务（监听参数仅在启动时读取）。
+// 所有请求的 context 派生自 ctx；ctx 结束后停止接收新连接、取消进行中的流并等待退出
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	lc := s.Store.Get().Listen
+	addrs := lc.Addrs()
+	srv := &http.Server{
+		Addr:              addrs[0],
+		Handler:           s.Handler(),
+		ReadTimeout:       10 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      0,
+		IdleTimeout:       120 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	scheme := "http"
+	if lc.TLS.Enabled() {
+		certs, err := newCertReloader(lc.TLS)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+		go certs.watchSignal(ctx)
+		scheme = "https"
+	}
+
+	// 待机状态在开始监听前设置，避免第一个请求被当作活动节点处理
+	standby := s.haStart()
+
+	lns := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		ln, err := Listen(addr, lc.TCP)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		lns = append(lns, ln)
+		log.Printf("[StreamProxy] 监听 %s://%s/stream", scheme, addr)
+	}
+	log.Printf("[StreamProxy] 配置文件: %s", abs(s.Store.Path()))
+
+	if standby {
+		go s.haLoop(ctx)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		log.Printf("[StreamProxy] 正在关闭，等待活跃连接退出...")
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Printf("[StreamProxy] 等待超时，强制关闭: %v", err)
+			srv.Close()
+		}
+	}()
+
+	serve := srv.Serve
+	if srv.TLSConfig != nil {
+		serve = func(ln net.Listener) error { return srv.ServeTLS(ln, "", "") }
+	}
+	errc := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func() { errc <- serve(ln) }()
+	}
+	for range lns {
+		if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	<-stopped
+	return nil
+}
+
+func abs(p string) string {
+	ap, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	return ap
+}
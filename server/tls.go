@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"r9mc.com/stream-proxy/config"
+)
+
+// 证书文件检查间隔：握手时最多每隔这么久 stat 一次
+const certCheckInterval = time.Second
+
+// certReloader 证书/私钥文件变化或收到 SIGHUP 时重新加载；
+// 只影响新握手，已建立的连接（进行中的流）不受影响
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	mtime   [2]int64
+	checked time.Time
+}
+
+func newCertReloader(tc config.TLSCfg) (*certReloader, error) {
+	r := &certReloader{certFile: tc.Cert, keyFile: tc.Key}
+	mt, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(mt); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) stat() ([2]int64, error) {
+	var mt [2]int64
+	for i, f := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return mt, err
+		}
+		mt[i] = fi.ModTime().UnixNano()
+	}
+	return mt, nil
+}
+
+// 需持有 mu（初始化时除外）
+func (r *certReloader) load(mt [2]int64) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.mtime = &cert, mt
+	if cert.Leaf != nil {
+		log.Printf("[StreamProxy] 已加载 TLS 证书: subject=%s, 到期 %s", cert.Leaf.Subject, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// 重新加载；force 为 false 时仅在文件修改时间变化后加载。失败则沿用旧证书
+func (r *certReloader) reload(force bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checked = time.Now()
+	mt, err := r.stat()
+	if err != nil {
+		log.Printf("[StreamProxy] 读取 TLS 证书失败，沿用旧证书: %v", err)
+		return
+	}
+	if !force && mt == r.mtime {
+		return
+	}
+	// 证书与私钥可能先后写入，不匹配时下次检查再试
+	if err := r.load(mt); err != nil {
+		log.Printf("[StreamProxy] 加载 TLS 证书失败，沿用旧证书: %v", err)
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	due := time.Since(r.checked) >= certCheckInterval
+	r.mu.Unlock()
+	if due {
+		r.reload(false)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+// 收到 SIGHUP 时强制重新加载
+func (r *certReloader) watchSignal(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			log.Printf("[StreamProxy] 收到 SIGHUP，重新加载 TLS 证书")
+			r.reload(true)
+		}
+	}
+}
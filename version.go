@@ -0,0 +1,36 @@
+package main
+
+import (
+	"cmp"
+	"runtime"
+	"runtime/debug"
+
+	"r9mc.com/stream-proxy/proxy"
+)
+
+// 构建时注入：go build -ldflags "-X 'main.version=v1.2.3' -X 'main.commit=abc1234' -X 'main.date=2024-01-01T00:00:00Z'"
+var (
+	version string
+	commit  string
+	date    string
+)
+
+// 未注入时从 Go 记录的 VCS 信息中补全
+func buildInfo() proxy.BuildInfo {
+	b := proxy.BuildInfo{Version: version, Commit: commit, Date: date, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "" && bi.Main.Version != "(devel)" {
+			b.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				b.Commit = cmp.Or(b.Commit, s.Value)
+			case "vcs.time":
+				b.Date = cmp.Or(b.Date, s.Value)
+			}
+		}
+	}
+	b.Version = cmp.Or(b.Version, "dev")
+	return b
+}